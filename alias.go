@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/jinzhu/gorm"
+)
+
+// Aliases are the alternative names of tags, they're stored as items of alias type with the tag
+// as the parent and share the names with tags
+
+const aliasesXattr = "user.memetagfs.aliases"
+
+// sameNamespace returns the types of items that can't have the same name as the item of type t
+func sameNamespace(t itemType) []itemType {
+	if t == grouptag {
+		return []itemType{grouptag}
+	}
+	return []itemType{tag, alias}
+}
+
+func tagAliases(tagID id) []string {
+	var aliases []item
+	db.Order("name ASC").Find(&aliases, "parent_id = ? AND type = ?", tagID, alias)
+	result := make([]string, len(aliases))
+	for i := range aliases {
+		result[i] = aliases[i].Name
+	}
+	return result
+}
+
+// updateAliases replaces the aliases of the tag, they must not clash with other tags and aliases
+func updateAliases(tx *gorm.DB, i *item, aliases []string) error {
+	if err := tx.Delete(&item{}, "parent_id = ? AND type = ?", i.ID, alias).Error; err != nil {
+		return err
+	}
+	for _, name := range aliases {
+		if !validTagName(name) || name == i.Name {
+			return syscall.EINVAL
+		}
+		if !tx.First(&item{}, "name = ? AND type IN (?)", name, sameNamespace(alias)).RecordNotFound() {
+			return syscall.EEXIST
+		}
+		if err := tx.Create(&item{Name: name, Type: alias, ParentID: i.ID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalTag finds the tag by its name or alias
+func canonicalTag(name string) (*item, bool) {
+	var result item
+	if db.First(&result, "name = ? AND type IN (?)", name, sameNamespace(tag)).RecordNotFound() {
+		return nil, false
+	}
+	if result.Type != alias {
+		return &result, true
+	}
+	var parent item
+	if db.First(&parent, "id = ? AND type = ?", result.ParentID, tag).RecordNotFound() {
+		return nil, false
+	}
+	return &parent, true
+}
+
+// canonicalNames replaces the aliases with the tag names, unknown names are kept
+func canonicalNames(names []string) []string {
+	result := make([]string, len(names))
+	for i, name := range names {
+		result[i] = name
+		if t, ok := canonicalTag(name); ok {
+			result[i] = t.Name
+		}
+	}
+	return result
+}
+
+func (t tagsDir) isTag() bool {
+	return t.ID != 0 && !db.First(&item{}, "id = ? AND type = ?", t.ID, tag).RecordNotFound()
+}
+
+func (t tagsDir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name != aliasesXattr || !t.isTag() {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(strings.Join(tagAliases(t.ID), ", "))
+	return nil
+}
+
+func (t tagsDir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if t.isTag() {
+		resp.Append(aliasesXattr)
+	}
+	return nil
+}
+
+func (t tagsDir) setAliases(aliases []string) error {
+	if readOnly {
+		return syscall.EROFS
+	}
+	var target item
+	if db.First(&target, "id = ? AND type = ?", t.ID, tag).RecordNotFound() {
+		return syscall.ENOTSUP
+	}
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	if err := updateAliases(tx, &target, aliases); err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+func (t tagsDir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if req.Name != aliasesXattr {
+		return syscall.ENOTSUP
+	}
+	return t.setAliases(parseTagList(string(req.Xattr)))
+}
+
+func (t tagsDir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if req.Name != aliasesXattr {
+		return fuse.ErrNoXattr
+	}
+	return t.setAliases(nil)
+}
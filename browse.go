@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 
 	"bazil.org/fuse"
@@ -41,6 +42,17 @@ func (b browseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		}
 		addItems(items, baseItems)
 	}
+	if allTags := b.getAllTags(); len(allTags) > 1 && allTags[len(allTags)-1] == unionTag {
+		// suggest the siblings of the tag being united with
+		var unitedItem item
+		if !db.First(&unitedItem, "name = ? AND type = ?", allTags[len(allTags)-2], tag).RecordNotFound() {
+			var siblingItems []item
+			if err := db.Find(&siblingItems, "parent_id = ? AND name NOT IN (?) AND type = ?", unitedItem.ParentID, excludeTagNames, tag).Error; err != nil {
+				return nil, err
+			}
+			addItems(items, siblingItems)
+		}
+	}
 	for _, activeTagName := range positiveTagNames {
 		var activeItem item
 		if !db.First(&activeItem, "name = ?", activeTagName).RecordNotFound() {
@@ -66,11 +78,14 @@ func (b browseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		result = append(result, fuse.Dirent{Inode: uint64(v.ID), Name: v.Name, Type: fuse.DT_Dir})
 		b.cache.put(v.Name, &v)
 	}
-	if path.Base(b.tags) != negativeTag {
+	if base := path.Base(b.tags); base != negativeTag && base != unionTag {
 		result = append(result,
 			fuse.Dirent{Name: contentTag, Type: fuse.DT_Dir},
 			fuse.Dirent{Name: allTagsTag, Type: fuse.DT_Dir},
 			fuse.Dirent{Name: negativeTag, Type: fuse.DT_Dir})
+		if b.tags != "" && !strings.HasPrefix(base, queryPrefix) {
+			result = append(result, fuse.Dirent{Name: unionTag, Type: fuse.DT_Dir})
+		}
 	}
 	return result, nil
 }
@@ -78,18 +93,32 @@ func (b browseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (b browseDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	switch name {
 	case contentTag:
-		return filesDir{hasTags: hasTags{tags: b.tags}, cache: newCache()}, nil
+		return filesDir{hasTags: b.hasTags, cache: newCache()}, nil
 	case allTagsTag:
-		return filesDir{hasTags: hasTags{tags: b.tags}, allTags: true, cache: newCache()}, nil
+		return filesDir{hasTags: b.hasTags, allTags: true, cache: newCache()}, nil
 	case negativeTag:
-		return browseDir{hasTags: hasTags{tags: path.Join(b.tags, negativeTag)}, cache: newCache()}, nil
+		return browseDir{hasTags: b.join(negativeTag), cache: newCache()}, nil
+	case unionTag:
+		if strings.HasPrefix(path.Base(b.tags), queryPrefix) {
+			return nil, syscall.EINVAL
+		}
+		return browseDir{hasTags: b.join(unionTag), cache: newCache()}, nil
+	}
+	if strings.HasPrefix(name, queryPrefix) {
+		if _, err := parseQuery(strings.TrimPrefix(name, queryPrefix)); err != nil {
+			return nil, syscall.EINVAL
+		}
+		return browseDir{hasTags: b.join(name), cache: newCache()}, nil
 	}
 	if _, ok := b.cache.get(name); ok {
-		return browseDir{hasTags: hasTags{tags: path.Join(b.tags, name)}, cache: newCache()}, nil
+		return browseDir{hasTags: b.join(name), cache: newCache()}, nil
+	}
+	if t, ok := canonicalTag(name); ok {
+		return browseDir{hasTags: b.join(t.Name), cache: newCache()}, nil
 	}
 	var result item
 	if !db.First(&result, "name = ?", name).RecordNotFound() {
-		return browseDir{hasTags: hasTags{tags: path.Join(b.tags, result.Name)}, cache: newCache()}, nil
+		return browseDir{hasTags: b.join(result.Name), cache: newCache()}, nil
 	}
 	return nil, syscall.ENOENT
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/docopt/docopt-go"
+)
+
+// The commands below work on the database directly through the same nodes the mounted filesystem uses
+
+// lookupPath resolves the path relative to the filesystem root
+func lookupPath(p string) (fs.Node, error) {
+	var node fs.Node = rootDir{}
+	for _, name := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		lookuper, ok := node.(fs.NodeStringLookuper)
+		if !ok {
+			return nil, syscall.ENOTDIR
+		}
+		var err error
+		if node, err = lookuper.Lookup(context.Background(), name); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// findItemID accepts either the item ID or its path like browse/cats/@/cat.jpg
+func findItemID(s string) (id, error) {
+	if itemID, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if db.First(&item{}, "id = ? AND type IN (?)", itemID, []itemType{file, dir}).RecordNotFound() {
+			return 0, fmt.Errorf("file %d not found", itemID)
+		}
+		return id(itemID), nil
+	}
+	node, err := lookupPath(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", s, err)
+	}
+	switch n := node.(type) {
+	case content:
+		return id(n.id), nil
+	case filesDir:
+		if n.dirID != 0 {
+			return n.dirID, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a file or directory", s)
+}
+
+func tagCommand(add bool, file string, names []string) error {
+	itemID, err := findItemID(file)
+	if err != nil {
+		return err
+	}
+	tags, err := itemTags(db, itemID)
+	if err != nil {
+		return err
+	}
+	names = parseTagList(strings.Join(names, ","))
+	change := map[string]bool{}
+	for _, name := range names {
+		change[name] = true
+	}
+	var result []string
+	for _, t := range tags {
+		if !change[t.Name] {
+			result = append(result, t.Name)
+		}
+	}
+	if add {
+		result = append(result, names...)
+	}
+	if err := setItemTags(itemID, result); err != nil {
+		if err == syscall.EINVAL {
+			return errors.New("unknown tags specified")
+		}
+		return err
+	}
+	return nil
+}
+
+func lsCommand(query string) error {
+	components := strings.Split(query, "/")
+	for i, name := range components {
+		if strings.HasPrefix(name, queryPrefix) {
+			if _, err := parseQuery(strings.TrimPrefix(name, queryPrefix)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		} else if name != negativeTag && name != unionTag && name != contentTag && name != allTagsTag {
+			components[i] = canonicalNames([]string{name})[0]
+		}
+	}
+	query = strings.Join(components, "/")
+	if err := (hasTags{tags: query}).checkUnions(); err != nil {
+		return errors.New("expressions can't be united with tags, use or inside the expression")
+	}
+	positive, negative := hasTags{tags: query}.getTagsWithNegative()
+	for _, name := range append(positive, negative...) {
+		if db.First(&item{}, "name = ? AND type = ?", name, tag).RecordNotFound() {
+			return fmt.Errorf("unknown tag %s", name)
+		}
+	}
+	ents, err := filesDir{hasTags: hasTags{tags: query}, allTags: true, cache: newCache()}.ReadDirAll(context.Background())
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range ents {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		if e.Type == fuse.DT_Dir {
+			e.Name += "/"
+		}
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// tagParent returns the tags directory containing the tag specified as a path like animals/cats
+func tagParent(p string) (tagsDir, string, error) {
+	dir, name := path.Split(strings.Trim(p, "/"))
+	node, err := lookupPath(path.Join(control, dir))
+	if err != nil {
+		return tagsDir{}, "", fmt.Errorf("%s: %v", dir, err)
+	}
+	parent, ok := node.(tagsDir)
+	if !ok {
+		return tagsDir{}, "", fmt.Errorf("%s is not a tag directory", dir)
+	}
+	return parent, name, nil
+}
+
+func mktagCommand(p string) error {
+	parent, name, err := tagParent(p)
+	if err != nil {
+		return err
+	}
+	if _, err := parent.Mkdir(context.Background(), &fuse.MkdirRequest{Name: name}); err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	return nil
+}
+
+func mvtagCommand(src, dst string) error {
+	srcParent, srcName, err := tagParent(src)
+	if err != nil {
+		return err
+	}
+	dstParent, dstName, err := tagParent(dst)
+	if err != nil {
+		return err
+	}
+	if err := srcParent.Rename(context.Background(), &fuse.RenameRequest{OldName: srcName, NewName: dstName}, dstParent); err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	return nil
+}
+
+// runCommand runs the offline command if it was specified
+func runCommand(opts docopt.Opts) (bool, error) {
+	switch {
+	case opts["query"] == true:
+		switch {
+		case opts["set"] == true:
+			return true, setQueryCommand(opts["<name>"].(string), opts["<query>"].(string))
+		case opts["rm"] == true:
+			return true, rmQueryCommand(opts["<name>"].(string))
+		}
+		return true, listQueries()
+	case opts["imply"] == true:
+		switch {
+		case opts["add"] == true:
+			return true, addImplication(opts["<tag>"].(string), opts["<implied>"].(string))
+		case opts["rm"] == true:
+			return true, removeImplication(opts["<tag>"].(string), opts["<implied>"].(string))
+		case opts["apply"] == true:
+			return true, applyImplications()
+		}
+		return true, listImplications()
+	case opts["tag"] == true:
+		add, _ := opts.Bool("add")
+		return true, tagCommand(add, opts["<file>"].(string), opts["<tags>"].([]string))
+	case opts["ls"] == true:
+		return true, lsCommand(opts["<query>"].(string))
+	case opts["mktag"] == true:
+		return true, mktagCommand(opts["<tag>"].(string))
+	case opts["merge-tag"] == true:
+		return true, mergeCommand(opts["<tag>"].(string), opts["<dsttag>"].(string))
+	case opts["rmtag"] == true:
+		replace, _ := opts.String("--replace")
+		allowUntagged, _ := opts.Bool("--allow-untagged")
+		return true, rmtagCommand(opts["<tag>"].(string), replace, allowUntagged)
+	case opts["mvtag"] == true:
+		return true, mvtagCommand(opts["<tag>"].(string), opts["<newtag>"].(string))
+	case opts["search"] == true:
+		return true, searchCommand(opts["<terms>"].([]string))
+	case opts["note"] == true:
+		notes, set := opts["<notes>"].(string)
+		return true, noteCommand(opts["<file>"].(string), notes, set)
+	}
+	return false, nil
+}
@@ -76,7 +76,7 @@ func pack(cfg buildConfig, wg *sync.WaitGroup) {
 }
 
 func build(cfg buildConfig, versionFlags string, wg *sync.WaitGroup) {
-	cmd := exec.Command("go", "build", "-ldflags", "-s -w "+versionFlags+" -extldflags -static", "-o", cfg.binaryName())
+	cmd := exec.Command("go", "build", "-tags", "sqlite_fts5", "-ldflags", "-s -w "+versionFlags+" -extldflags -static", "-o", cfg.binaryName())
 	cmd.Env = append(os.Environ(), "GOOS="+cfg.os, "GOARCH="+cfg.arch, "CGO_ENABLED=1")
 	if cfg.crossCompiler != "" {
 		cmd.Env = append(cmd.Env, "CC="+cfg.crossCompiler)
@@ -2,10 +2,8 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"os"
-	"path"
 	"syscall"
 	"time"
 
@@ -20,63 +18,35 @@ type content struct {
 }
 
 type virtualFile struct {
-	handle *os.File
+	handle storageFile
 }
 
 var contentCache *fileCache = newCache()
 
-func nameByID(db *gorm.DB, itemID uint64) (string, error) {
+func storedItemByID(db *gorm.DB, itemID uint64) (*item, error) {
 	if cached, ok := contentCache.getByID(id(itemID)); ok {
 		if cached.missing {
-			return "", syscall.ENOENT
+			return nil, syscall.ENOENT
 		}
-		return cached.Name, nil
+		return cached, nil
 	}
 	var result item
-	if db.Model(&item{}).Select("name").First(&result, "id = ?", itemID).RecordNotFound() {
+	if db.Model(&item{}).Select("id, name, hash, created_at").First(&result, "id = ?", itemID).RecordNotFound() {
 		contentCache.putMissingID(id(itemID))
-		return "", syscall.ENOENT
+		return nil, syscall.ENOENT
 	}
 	contentCache.putID(id(itemID), &result)
-	return result.Name, nil
-}
-
-func filePath(id uint64) (string, error) {
-	return filePathWithTx(db, id)
-}
-
-func filePathWithTx(tx *gorm.DB, id uint64) (string, error) {
-	name, err := nameByID(tx, id)
-	if err != nil {
-		return "", err
-	}
-	return filePathWithNameTx(id, name)
-}
-
-func filePathWithNameTx(id uint64, name string) (string, error) {
-	first := fmt.Sprintf("%06d", id/10000)
-	second := fmt.Sprintf("%02d", (id/100)%100)
-	dir := path.Join(storagePath, first, second)
-	os.MkdirAll(dir, 0755)
-	return path.Join(dir, fmt.Sprintf("%010d_%s", id, name)), nil
-}
-
-func (c content) filePathWithTx(tx *gorm.DB) (string, error) {
-	return filePathWithTx(tx, c.id)
-}
-
-func (c content) filePath() (string, error) {
-	return filePath(c.id)
+	return &result, nil
 }
 
 func (c content) Attr(ctx context.Context, attr *fuse.Attr) error {
 	attr.Inode = c.id
 	if c.itype == file {
-		path, err := c.filePath()
+		i, err := storedItemByID(db, c.id)
 		if err != nil {
 			return err
 		}
-		fi, err := os.Stat(path)
+		fi, err := store.Stat(i)
 		if err != nil {
 			return syscall.ENOENT
 		}
@@ -85,6 +55,9 @@ func (c content) Attr(ctx context.Context, attr *fuse.Attr) error {
 		attr.Atime = time.Now()
 		attr.Ctime = fi.ModTime()
 		attr.Mtime = fi.ModTime()
+		if i.CreatedAt != nil {
+			attr.Crtime = *i.CreatedAt
+		}
 	} else {
 		attr.Mode = os.ModeDir | 0755
 		attr.Size = 4096
@@ -98,12 +71,14 @@ func (c content) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Ope
 	if req.Dir {
 		return nil, syscall.EINVAL
 	}
-	var path string
-	path, err := c.filePath()
+	if readOnly && !req.Flags.IsReadOnly() {
+		return nil, syscall.EROFS
+	}
+	i, err := storedItemByID(db, c.id)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.OpenFile(path, int(req.Flags), os.ModePerm)
+	f, err := store.Open(i, int(req.Flags))
 	if err != nil {
 		return nil, err
 	}
@@ -111,12 +86,17 @@ func (c content) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Ope
 }
 
 func (c content) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if readOnly {
+		return syscall.EROFS
+	}
 	if req.Valid.Size() {
-		path, err := c.filePath()
+		i, err := storedItemByID(db, c.id)
 		if err != nil {
 			return err
 		}
-		os.Truncate(path, int64(req.Size))
+		if err := store.Truncate(i, int64(req.Size)); err != nil {
+			return err
+		}
 		resp.Attr.Size = req.Size
 	}
 	c.Attr(ctx, &resp.Attr)
@@ -138,6 +118,9 @@ func (v virtualFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse
 }
 
 func (v virtualFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if readOnly {
+		return syscall.EROFS
+	}
 	var n int
 	var err error
 	if int(req.FileFlags)&os.O_APPEND != 0 {
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The encrypted storage uses the sharded layout with encrypted file names. File contents are split
+// to chunks encrypted with AES-GCM separately so that they can be read and written at any offset.
+// Every chunk is stored as nonce + ciphertext + tag, the nonce is random and changes on every write.
+// The last chunk is sealed with a flag so that a file cut at the chunk boundary is detected.
+
+const (
+	encryptionFile = "encryption.txt"
+	encryptingFile = "encrypting"
+	cryptChunkSize = 64 * 1024
+	cryptOverhead  = 12 + 16
+	cryptDiskChunk = cryptChunkSize + cryptOverhead
+	kdfIterations  = 100000
+	keyCheck       = "memetagfs key check"
+	// longer names don't fit the filesystem limits after encryption and are truncated, such names
+	// can't be recovered from lost files
+	maxEncryptedName = 240
+)
+
+var errBadKey = errors.New("invalid key, can't decrypt the storage")
+
+type encryptedStorage struct {
+	aead    cipher.AEAD
+	nameKey []byte
+}
+
+func newEncryptedStorage(key []byte) (encryptedStorage, error) {
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return encryptedStorage{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return encryptedStorage{}, err
+	}
+	return encryptedStorage{aead: aead, nameKey: key[32:]}, nil
+}
+
+func readKeyfile(keyfile string) ([]byte, error) {
+	var passphrase []byte
+	var err error
+	if keyfile == "-" {
+		passphrase, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		passphrase, err = ioutil.ReadFile(keyfile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	passphrase = []byte(strings.TrimRight(string(passphrase), "\r\n"))
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty key")
+	}
+	return passphrase, nil
+}
+
+func checksum(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyCheck))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setupEncryption enables the encrypted storage and encrypts the existing files if it's not encrypted yet
+func setupEncryption(keyfile string) error {
+	marker := path.Join(storagePath, encryptionFile)
+	params, err := ioutil.ReadFile(marker)
+	encrypted := err == nil
+	if keyfile == "" {
+		if encrypted {
+			return errors.New("the storage is encrypted, specify the key file")
+		}
+		return nil
+	}
+	// checked before any marker is written so the storage stays usable
+	if _, ok := store.(dedupStorage); ok {
+		return errors.New("encryption of the deduplicated storage is not supported")
+	}
+	passphrase, err := readKeyfile(keyfile)
+	if err != nil {
+		return err
+	}
+	var salt []byte
+	if encrypted {
+		lines := strings.Split(strings.TrimSpace(string(params)), "\n")
+		if len(lines) != 2 {
+			return fmt.Errorf("%s is corrupted", marker)
+		}
+		if salt, err = hex.DecodeString(lines[0]); err != nil {
+			return err
+		}
+		key := pbkdf2.Key(passphrase, salt, kdfIterations, 64, sha256.New)
+		if !hmac.Equal([]byte(checksum(key)), []byte(lines[1])) {
+			return errBadKey
+		}
+		if store, err = newEncryptedStorage(key); err != nil {
+			return err
+		}
+	} else {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		key := pbkdf2.Key(passphrase, salt, kdfIterations, 64, sha256.New)
+		if store, err = newEncryptedStorage(key); err != nil {
+			return err
+		}
+		// the marker protects against interrupted encryption
+		if err := ioutil.WriteFile(path.Join(storagePath, encryptingFile), nil, 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(marker, []byte(hex.EncodeToString(salt)+"\n"+checksum(key)+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+	if exists(path.Join(storagePath, encryptingFile)) {
+		if err := encryptFiles(store.(encryptedStorage)); err != nil {
+			return err
+		}
+		return os.Remove(path.Join(storagePath, encryptingFile))
+	}
+	return nil
+}
+
+// encryptFiles encrypts the files stored in plain text
+func encryptFiles(s encryptedStorage) error {
+	var items []item
+	if err := db.Select("id, name").Find(&items, "type = ?", file).Error; err != nil {
+		return err
+	}
+	log.Printf("Encrypting %d files...", len(items))
+	for i := range items {
+		plain, err := filePathWithNameTx(uint64(items[i].ID), items[i].Name)
+		if err != nil {
+			return err
+		}
+		if !exists(plain) {
+			continue
+		}
+		src, err := os.Open(plain)
+		if err != nil {
+			return err
+		}
+		dst, err := s.open(&items[i], os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("error encrypting %s: %v", plain, err)
+		}
+		if err := os.Remove(plain); err != nil {
+			return err
+		}
+	}
+	log.Println("Done.")
+	return nil
+}
+
+func (s encryptedStorage) encryptName(name string) string {
+	mac := hmac.New(sha256.New, s.nameKey)
+	mac.Write([]byte(name))
+	// the nonce is derived from the name so that the same name is always encrypted the same way
+	nonce := mac.Sum(nil)[:s.aead.NonceSize()]
+	result := base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(name), []byte("name")))
+	if len(result) > maxEncryptedName {
+		return result[:maxEncryptedName]
+	}
+	return result
+}
+
+func (s encryptedStorage) decryptName(encrypted string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < cryptOverhead {
+		return "", errBadKey
+	}
+	name, err := s.aead.Open(nil, data[:s.aead.NonceSize()], data[s.aead.NonceSize():], []byte("name"))
+	if err != nil {
+		return "", errBadKey
+	}
+	return string(name), nil
+}
+
+func (s encryptedStorage) pathWithName(itemID id, name string) string {
+	path, _ := filePathWithNameTx(uint64(itemID), s.encryptName(name))
+	return path
+}
+
+func (s encryptedStorage) path(i *item) string {
+	return s.pathWithName(i.ID, i.Name)
+}
+
+// open opens the file without updating the hash on close
+func (s encryptedStorage) open(i *item, flag int) (*encryptedFile, error) {
+	// the chunks are read before modifying so the file is always readable, appending is emulated
+	rawFlag := flag &^ (os.O_APPEND | os.O_WRONLY)
+	if !isReadOnly(flag) {
+		rawFlag |= os.O_RDWR
+	}
+	f, err := os.OpenFile(s.path(i), rawFlag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFile{f: f, aead: s.aead, itemID: i.ID, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (s encryptedStorage) Open(i *item, flag int) (storageFile, error) {
+	f, err := s.open(i, flag)
+	if err != nil {
+		return nil, err
+	}
+	if isReadOnly(flag) {
+		return f, nil
+	}
+	return hashedFile{encryptedFile: f, item: item{ID: i.ID, Name: i.Name}, db: db}, nil
+}
+
+func (s encryptedStorage) Create(db *gorm.DB, i *item) (storageFile, error) {
+	f, err := s.open(i, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	return hashedFile{encryptedFile: f, item: item{ID: i.ID, Name: i.Name}, db: db}, nil
+}
+
+func (s encryptedStorage) Stat(i *item) (os.FileInfo, error) {
+	fi, err := os.Stat(s.path(i))
+	if err != nil {
+		return nil, err
+	}
+	return encryptedFileInfo{FileInfo: fi}, nil
+}
+
+func (s encryptedStorage) Remove(i *item) error {
+	if err := os.Remove(s.path(i)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s encryptedStorage) Rename(i *item, oldName string) error {
+	return os.Rename(s.pathWithName(i.ID, oldName), s.path(i))
+}
+
+func (s encryptedStorage) Truncate(i *item, size int64) error {
+	f, err := s.Open(i, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	err = f.(hashedFile).Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s encryptedStorage) Walk(fn func(path string, i *item) error) error {
+	return walkSharded(func(itemID, encrypted string) (string, error) {
+		name, err := s.decryptName(encrypted)
+		if err == nil || len(encrypted) < maxEncryptedName {
+			return name, err
+		}
+		// truncated names can only be compared to the known name
+		var i item
+		if db.Select("name").First(&i, "id = ? AND type = ?", itemID, file).RecordNotFound() ||
+			s.encryptName(i.Name) != encrypted {
+			return "", err
+		}
+		return i.Name, nil
+	}, fn)
+}
+
+// OpenLost decrypts the lost file if possible, otherwise it's returned as is
+func (s encryptedStorage) OpenLost(lostPath string) (string, io.ReadCloser, error) {
+	raw := func() (string, io.ReadCloser, error) {
+		f, err := os.Open(lostPath)
+		return filepath.Base(lostPath), f, err
+	}
+	match := filenameRegex.FindStringSubmatch(filepath.Base(lostPath))
+	if match == nil {
+		return raw()
+	}
+	name, err := s.decryptName(match[2])
+	if err != nil {
+		return raw()
+	}
+	var itemID id
+	fmt.Sscan(match[1], &itemID)
+	f, err := os.Open(lostPath)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, &encryptedFile{f: f, aead: s.aead, itemID: itemID}, nil
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func plainSize(size int64) int64 {
+	result := size / cryptDiskChunk * cryptChunkSize
+	if rem := size % cryptDiskChunk; rem > cryptOverhead {
+		result += rem - cryptOverhead
+	}
+	return result
+}
+
+func (e encryptedFileInfo) Size() int64 {
+	return plainSize(e.FileInfo.Size())
+}
+
+// fileLocks holds a mutex per item ID so that the chunks aren't modified through several handles
+// of the same file at once
+var fileLocks sync.Map
+
+type encryptedFile struct {
+	f      *os.File
+	aead   cipher.AEAD
+	itemID id
+	append bool
+	offset int64
+}
+
+// hashedFile updates the file hash when closed after writing
+type hashedFile struct {
+	*encryptedFile
+	item item
+	db   *gorm.DB
+}
+
+func (h hashedFile) Close() error {
+	if err := h.encryptedFile.Close(); err != nil {
+		return err
+	}
+	hash, err := hashItem(&h.item)
+	if err != nil {
+		return err
+	}
+	return setHash(h.db, h.item.ID, hash)
+}
+
+// additionalData binds the chunk to its file and position
+func (e *encryptedFile) additionalData(chunk int64, last bool) []byte {
+	result := make([]byte, 17)
+	binary.BigEndian.PutUint64(result, uint64(e.itemID))
+	binary.BigEndian.PutUint64(result[8:], uint64(chunk))
+	if last {
+		result[16] = 1
+	}
+	return result
+}
+
+func (e *encryptedFile) size() (int64, error) {
+	fi, err := e.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return plainSize(fi.Size()), nil
+}
+
+func (e *encryptedFile) readChunk(chunk int64) ([]byte, error) {
+	// one more byte is read to find out if the chunk is the last one
+	buf := make([]byte, cryptDiskChunk+1)
+	n, err := e.f.ReadAt(buf, chunk*cryptDiskChunk)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	last := n <= cryptDiskChunk
+	if !last {
+		n = cryptDiskChunk
+	}
+	if n <= cryptOverhead {
+		return nil, fmt.Errorf("chunk %d of file %d is truncated", chunk, e.itemID)
+	}
+	nonceSize := e.aead.NonceSize()
+	result, err := e.aead.Open(nil, buf[:nonceSize], buf[nonceSize:n], e.additionalData(chunk, last))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d of file %d is corrupted: %v", chunk, e.itemID, err)
+	}
+	return result, nil
+}
+
+func (e *encryptedFile) writeChunk(chunk int64, data []byte, last bool) error {
+	nonce := make([]byte, e.aead.NonceSize(), cryptDiskChunk)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	_, err := e.f.WriteAt(e.aead.Seal(nonce, nonce, data, e.additionalData(chunk, last)), chunk*cryptDiskChunk)
+	return err
+}
+
+func (e *encryptedFile) readAt(p []byte, off int64) (int, error) {
+	size, err := e.size()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < size {
+		pos := off + int64(n)
+		data, err := e.readChunk(pos / cryptChunkSize)
+		if err != nil {
+			return n, err
+		}
+		within := int(pos % cryptChunkSize)
+		if within >= len(data) {
+			break
+		}
+		n += copy(p[n:], data[within:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (e *encryptedFile) writeAt(p []byte, off int64) (int, error) {
+	size, err := e.size()
+	if err != nil {
+		return 0, err
+	}
+	if off > size {
+		// fill the gap with zeros
+		if err := e.truncate(off); err != nil {
+			return 0, err
+		}
+		size = off
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	newSize := size
+	if end := off + int64(len(p)); end > newSize {
+		newSize = end
+	}
+	lastChunk := (newSize - 1) / cryptChunkSize
+	if off == size && size > 0 && size%cryptChunkSize == 0 {
+		// the full last chunk isn't overwritten but stops being the last one
+		data, err := e.readChunk(size/cryptChunkSize - 1)
+		if err != nil {
+			return 0, err
+		}
+		if err := e.writeChunk(size/cryptChunkSize-1, data, false); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := pos / cryptChunkSize
+		within := int(pos % cryptChunkSize)
+		var data []byte
+		if chunk*cryptChunkSize < size {
+			if data, err = e.readChunk(chunk); err != nil {
+				return n, err
+			}
+		}
+		count := cryptChunkSize - within
+		if count > len(p)-n {
+			count = len(p) - n
+		}
+		if len(data) < within+count {
+			data = append(data, make([]byte, within+count-len(data))...)
+		}
+		copy(data[within:], p[n:n+count])
+		if err := e.writeChunk(chunk, data, chunk == lastChunk); err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+func (e *encryptedFile) truncate(newSize int64) error {
+	size, err := e.size()
+	if err != nil {
+		return err
+	}
+	if newSize > size {
+		zeros := make([]byte, cryptChunkSize)
+		for size < newSize {
+			count := newSize - size
+			if count > cryptChunkSize {
+				count = cryptChunkSize
+			}
+			n, err := e.writeAt(zeros[:count], size)
+			if err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		return nil
+	}
+	if newSize == size {
+		return nil
+	}
+	chunk := newSize / cryptChunkSize
+	within := newSize % cryptChunkSize
+	// the new last chunk is rewritten to be sealed as the last one
+	last := chunk
+	if within == 0 {
+		last--
+	}
+	var data []byte
+	if last >= 0 {
+		if data, err = e.readChunk(last); err != nil {
+			return err
+		}
+	}
+	if err := e.f.Truncate(chunk * cryptDiskChunk); err != nil {
+		return err
+	}
+	if within > 0 {
+		return e.writeChunk(chunk, data[:within], true)
+	}
+	if last >= 0 {
+		return e.writeChunk(last, data, true)
+	}
+	return nil
+}
+
+func (e *encryptedFile) lock() func() {
+	m, _ := fileLocks.LoadOrStore(e.itemID, &sync.Mutex{})
+	m.(*sync.Mutex).Lock()
+	return m.(*sync.Mutex).Unlock
+}
+
+func (e *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	defer e.lock()()
+	return e.readAt(p, off)
+}
+
+func (e *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	defer e.lock()()
+	return e.writeAt(p, off)
+}
+
+func (e *encryptedFile) Truncate(size int64) error {
+	defer e.lock()()
+	return e.truncate(size)
+}
+
+func (e *encryptedFile) Read(p []byte) (int, error) {
+	defer e.lock()()
+	n, err := e.readAt(p, e.offset)
+	e.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (e *encryptedFile) Write(p []byte) (int, error) {
+	defer e.lock()()
+	if e.append {
+		size, err := e.size()
+		if err != nil {
+			return 0, err
+		}
+		e.offset = size
+	}
+	n, err := e.writeAt(p, e.offset)
+	e.offset += int64(n)
+	return n, err
+}
+
+func (e *encryptedFile) Close() error {
+	return e.f.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestEncryptedFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "memetagfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	s, err := newEncryptedStorage(bytes.Repeat([]byte{1}, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &encryptedFile{f: f, aead: s.aead, itemID: 1}
+	defer e.Close()
+	var expected []byte
+	write := func(data []byte, off int64) {
+		if end := int(off) + len(data); end > len(expected) {
+			expected = append(expected, make([]byte, end-len(expected))...)
+		}
+		copy(expected[off:], data)
+		if n, err := e.WriteAt(data, off); err != nil || n != len(data) {
+			t.Fatalf("write %d bytes at %d: %d %v", len(data), off, n, err)
+		}
+	}
+	truncate := func(size int64) {
+		if size < int64(len(expected)) {
+			expected = expected[:size]
+		} else {
+			expected = append(expected, make([]byte, int(size)-len(expected))...)
+		}
+		if err := e.Truncate(size); err != nil {
+			t.Fatalf("truncate to %d: %v", size, err)
+		}
+	}
+	check := func(step string) {
+		size, err := e.size()
+		if err != nil || size != int64(len(expected)) {
+			t.Fatalf("%s: size %d %v, want %d", step, size, err, len(expected))
+		}
+		data := make([]byte, len(expected)+10)
+		n, _ := e.ReadAt(data, 0)
+		if !bytes.Equal(data[:n], expected) {
+			t.Fatalf("%s: contents differ", step)
+		}
+		// unaligned read across the chunks
+		if len(expected) > cryptChunkSize+10 {
+			data = make([]byte, 20)
+			if n, err := e.ReadAt(data, cryptChunkSize-10); err != nil || n != 20 ||
+				!bytes.Equal(data, expected[cryptChunkSize-10:cryptChunkSize+10]) {
+				t.Fatalf("%s: unaligned read differs: %d %v", step, n, err)
+			}
+		}
+	}
+	random := func(size int) []byte {
+		result := make([]byte, size)
+		rand.Read(result)
+		return result
+	}
+	write(random(1000), 0)
+	check("small write")
+	write(random(100), 333)
+	check("unaligned overwrite")
+	write(random(200), cryptChunkSize-100)
+	check("write across the chunk boundary")
+	write(random(3*cryptChunkSize+17), 12345)
+	check("write over several chunks")
+	write(random(10), 5*cryptChunkSize+7)
+	check("write after a gap")
+	truncate(2*cryptChunkSize + 3)
+	check("truncate within a chunk")
+	truncate(cryptChunkSize)
+	check("truncate at the chunk boundary")
+	truncate(cryptChunkSize + 5000)
+	check("extending truncate")
+	write(random(cryptChunkSize), cryptChunkSize/2)
+	check("write after truncate")
+	truncate(0)
+	check("truncate to zero")
+	write(random(2*cryptChunkSize), 0)
+	check("write of full chunks")
+	// a file cut at the chunk boundary must not be read as a shorter one
+	if err := f.Truncate(cryptDiskChunk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Fatal("cut file is read without errors")
+	}
+}
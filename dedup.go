@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// In the deduplicating storage (version 3) file contents are stored once per hash as blobs. Files
+// being written are copied (or moved if not shared) to the work-in-progress directory and put back
+// as blobs when the last writer closes them.
+
+const (
+	blobsDir = "blobs"
+	wipDir   = "wip"
+)
+
+// dedupStorage is the deduplicating storage layout
+type dedupStorage struct{}
+
+var (
+	writersLock sync.Mutex
+	writers     = map[uint64]int{}
+)
+
+// blobPath returns the path to the blob, the hash must be checked to be non-empty like in dedupPath
+// as the files that weren't hashed yet have no blob
+func blobPath(hash string) string {
+	return path.Join(storagePath, blobsDir, hash[:2], hash[2:4], hash)
+}
+
+func wipPath(itemID uint64) string {
+	return path.Join(storagePath, wipDir, fmt.Sprintf("%010d", itemID))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// dedupPath returns the path to the current file contents
+func dedupPath(itemID uint64, hash string) string {
+	wip := wipPath(itemID)
+	if hash == "" || exists(wip) {
+		return wip
+	}
+	return blobPath(hash)
+}
+
+func blobRefs(db *gorm.DB, hash string) (count int) {
+	db.Model(&item{}).Where("type = ? AND hash = ?", file, hash).Count(&count)
+	return
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// stage makes a private copy of the file contents for writing, shared blobs are copied and others
+// are just moved
+func stage(itemID uint64) (string, error) {
+	wip := wipPath(itemID)
+	if err := os.MkdirAll(path.Dir(wip), 0755); err != nil {
+		return "", err
+	}
+	if exists(wip) {
+		return wip, nil
+	}
+	i, err := storedItemByID(db, itemID)
+	if err != nil {
+		return "", err
+	}
+	if i.Hash == "" {
+		f, err := os.Create(wip)
+		if err != nil {
+			return "", err
+		}
+		return wip, f.Close()
+	}
+	if blobRefs(db, i.Hash) > 1 {
+		return wip, copyFile(blobPath(i.Hash), wip)
+	}
+	return wip, os.Rename(blobPath(i.Hash), wip)
+}
+
+// unstage puts the written file back to the blob storage
+func unstage(db *gorm.DB, itemID uint64) error {
+	wip := wipPath(itemID)
+	if !exists(wip) {
+		return nil
+	}
+	hash, err := hashFile(wip)
+	if err != nil {
+		return err
+	}
+	blob := blobPath(hash)
+	if exists(blob) {
+		if err := os.Remove(wip); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(wip, blob); err != nil {
+			return err
+		}
+	}
+	var i item
+	if db.Select("id, hash").First(&i, "id = ?", itemID).RecordNotFound() {
+		return removeUnreferencedBlob(db, hash)
+	}
+	if err := setHash(db, id(itemID), hash); err != nil {
+		return err
+	}
+	if i.Hash != hash {
+		return removeUnreferencedBlob(db, i.Hash)
+	}
+	return nil
+}
+
+func removeUnreferencedBlob(db *gorm.DB, hash string) error {
+	if hash == "" || blobRefs(db, hash) > 0 {
+		return nil
+	}
+	if err := os.Remove(blobPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// openWriter prepares the file for writing and registers a writer
+func openWriter(itemID uint64) (string, error) {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	wip, err := stage(itemID)
+	if err != nil {
+		return "", err
+	}
+	writers[itemID]++
+	return wip, nil
+}
+
+// createWriter registers a writer for a new file
+func createWriter(itemID uint64) (string, error) {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	wip := wipPath(itemID)
+	if err := os.MkdirAll(path.Dir(wip), 0755); err != nil {
+		return "", err
+	}
+	writers[itemID]++
+	return wip, nil
+}
+
+// closeWriter unregisters the writer and puts the file back to the blob storage if it was the last one
+func closeWriter(db *gorm.DB, itemID uint64) error {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	writers[itemID]--
+	if writers[itemID] > 0 {
+		return nil
+	}
+	delete(writers, itemID)
+	return unstage(db, itemID)
+}
+
+// unstageAll puts back the files left in the work-in-progress directory after a crash
+func unstageAll() error {
+	f, err := os.Open(path.Join(storagePath, wipDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		itemID, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			log.Printf("Unexpected file %s in %s", name, wipDir)
+			continue
+		}
+		if err := unstage(db, itemID); err != nil {
+			log.Printf("Error storing file %d: %v", itemID, err)
+		}
+	}
+	return nil
+}
+
+// owner returns an item the file in the deduplicated storage belongs to
+func owner(rel string) *item {
+	var i item
+	name := filepath.Base(rel)
+	switch strings.SplitN(rel, string(os.PathSeparator), 2)[0] {
+	case blobsDir:
+		if len(name) > 4 && path.Join(storagePath, rel) == blobPath(name) &&
+			!db.First(&i, "type = ? AND hash = ?", file, name).RecordNotFound() {
+			return &i
+		}
+	case wipDir:
+		itemID, err := strconv.ParseUint(name, 10, 64)
+		if err == nil && !db.First(&i, "id = ? AND type = ?", itemID, file).RecordNotFound() {
+			return &i
+		}
+	}
+	return nil
+}
+
+// migrateToDedup moves the files from the sharded storage to blobs
+func migrateToDedup() error {
+	var items []item
+	if err := db.Select("id, name, hash").Find(&items, "type = ?", file).Error; err != nil {
+		return err
+	}
+	for i := range items {
+		src, err := filePathWithNameTx(uint64(items[i].ID), items[i].Name)
+		if err != nil {
+			return err
+		}
+		if !exists(src) && items[i].Hash != "" && exists(blobPath(items[i].Hash)) {
+			// moved by the interrupted migration
+			continue
+		}
+		hash, err := hashFile(src)
+		if err != nil {
+			return fmt.Errorf("error hashing file %s, the storage isn't converted: %v", src, err)
+		}
+		if hash != items[i].Hash {
+			if err := db.Model(&item{}).Where("id = ?", items[i].ID).Update("hash", hash).Error; err != nil {
+				return err
+			}
+		}
+		blob := blobPath(hash)
+		if exists(blob) {
+			err = os.Remove(src)
+		} else if err = os.MkdirAll(path.Dir(blob), 0755); err == nil {
+			err = os.Rename(src, blob)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dedupStorage) Open(i *item, flag int) (storageFile, error) {
+	itemID := uint64(i.ID)
+	if isReadOnly(flag) {
+		return os.OpenFile(dedupPath(itemID, i.Hash), flag, os.ModePerm)
+	}
+	wip, err := openWriter(itemID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(wip, flag, os.ModePerm)
+	if err != nil {
+		closeWriter(db, itemID)
+		return nil, err
+	}
+	return writtenFile{File: f, done: func() error {
+		return closeWriter(db, itemID)
+	}}, nil
+}
+
+func (dedupStorage) Create(db *gorm.DB, i *item) (storageFile, error) {
+	itemID := uint64(i.ID)
+	wip, err := createWriter(itemID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(wip)
+	if err != nil {
+		closeWriter(db, itemID)
+		return nil, err
+	}
+	return writtenFile{File: f, done: func() error {
+		return closeWriter(db, itemID)
+	}}, nil
+}
+
+func (dedupStorage) Stat(i *item) (os.FileInfo, error) {
+	return os.Stat(dedupPath(uint64(i.ID), i.Hash))
+}
+
+func (dedupStorage) Remove(i *item) error {
+	if err := os.Remove(wipPath(uint64(i.ID))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeUnreferencedBlob(db, i.Hash)
+}
+
+// Rename does nothing as the file names aren't a part of the storage paths
+func (dedupStorage) Rename(i *item, oldName string) error {
+	return nil
+}
+
+func (dedupStorage) Truncate(i *item, size int64) error {
+	itemID := uint64(i.ID)
+	wip, err := openWriter(itemID)
+	if err != nil {
+		return err
+	}
+	err = os.Truncate(wip, size)
+	if cerr := closeWriter(db, itemID); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (dedupStorage) OpenLost(path string) (string, io.ReadCloser, error) {
+	f, err := os.Open(path)
+	return filepath.Base(path), f, err
+}
+
+func (dedupStorage) Walk(fn func(path string, i *item) error) error {
+	return filepath.Walk(storagePath, func(path string, info os.FileInfo, _ error) error {
+		if info == nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(storagePath, path)
+		if err != nil {
+			return err
+		}
+		if isServiceFile(rel) {
+			return nil
+		}
+		i := owner(rel)
+		if i == nil {
+			log.Printf("File %s is in storage but not in database", path)
+		}
+		return fn(path, i)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// duplicatesDir lists the hashes of files with identical contents as directories
+type duplicatesDir struct{}
+
+func (d duplicatesDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0755
+	attr.Size = 4096
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func duplicateHashes(hash string) ([]string, error) {
+	query := db.Model(&item{}).Where("type = ? AND hash != '' AND trashed_at IS NULL", file)
+	if hash != "" {
+		query = query.Where("hash = ?", hash)
+	}
+	var hashes []string
+	if err := query.Group("hash").Having("COUNT(*) > 1").Pluck("hash", &hashes).Error; err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func (d duplicatesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	hashes, err := duplicateHashes("")
+	if err != nil {
+		return nil, err
+	}
+	result := emptyDirAlloc(len(hashes))
+	for _, h := range hashes {
+		result = append(result, fuse.Dirent{Name: h, Type: fuse.DT_Dir})
+	}
+	return result, nil
+}
+
+func (d duplicatesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	hashes, err := duplicateHashes(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		return nil, syscall.ENOENT
+	}
+	return filesDir{allTags: true, hash: name, cache: newCache()}, nil
+}
+
+func (d duplicatesDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return nil, nil, syscall.EACCES
+}
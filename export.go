@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const exportVersion = 1
+
+var itemTypeNames = map[itemType]string{file: "file", dir: "dir", tag: "tag", grouptag: "grouptag", alias: "alias"}
+
+type exportedItem struct {
+	ID     id     `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Parent id     `json:"parent,omitempty"`
+	// tags of files and directories or the groups included by tags
+	Tags    []id `json:"tags,omitempty"`
+	Implies []id `json:"implies,omitempty"`
+	// path of the copied file relative to the files directory of the export
+	Path       string     `json:"path,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	TrashedAt  *time.Time `json:"trashed_at,omitempty"`
+	TrashDir   id         `json:"trash_dir,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ModifiedAt *time.Time `json:"modified_at,omitempty"`
+	Notes      string     `json:"notes,omitempty"`
+}
+
+// exportedQuery is the saved query, it refers to the tags by their names
+type exportedQuery struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+type exportedDatabase struct {
+	Version int             `json:"version"`
+	Items   []exportedItem  `json:"items"`
+	Queries []exportedQuery `json:"queries,omitempty"`
+}
+
+// exportFile copies the decrypted file contents from the storage
+func exportFile(i *item, dstPath string) error {
+	src, err := store.Open(i, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(path.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// exportJSON saves the database to the JSON document and copies the files to filesDir
+func exportJSON(filename, filesDir string) error {
+	var items []item
+	if err := db.Order("id ASC").Find(&items).Error; err != nil {
+		return err
+	}
+	rows, err := db.Table("item_tags").Select("item_id, other_id").Rows()
+	if err != nil {
+		return err
+	}
+	links := map[id][]id{}
+	for rows.Next() {
+		var itemID, otherID id
+		if err := rows.Scan(&itemID, &otherID); err != nil {
+			rows.Close()
+			return err
+		}
+		links[itemID] = append(links[itemID], otherID)
+	}
+	rows.Close()
+	var implications []implication
+	if err := db.Find(&implications).Error; err != nil {
+		return err
+	}
+	implies := map[id][]id{}
+	for _, im := range implications {
+		implies[im.TagID] = append(implies[im.TagID], im.ImpliedID)
+	}
+	var saved []savedQuery
+	if err := db.Order("name").Find(&saved).Error; err != nil {
+		return err
+	}
+	result := exportedDatabase{Version: exportVersion, Items: make([]exportedItem, len(items))}
+	for _, sq := range saved {
+		result.Queries = append(result.Queries, exportedQuery{Name: sq.Name, Query: sq.Query})
+	}
+	for idx := range items {
+		i := &items[idx]
+		result.Items[idx] = exportedItem{ID: i.ID, Name: i.Name, Type: itemTypeNames[i.Type], Parent: i.ParentID,
+			Tags: links[i.ID], Implies: implies[i.ID], Hash: i.Hash, TrashedAt: i.TrashedAt, TrashDir: i.TrashDir,
+			CreatedAt: i.CreatedAt, ModifiedAt: i.ModifiedAt, Notes: i.Notes}
+		if i.Type == file {
+			result.Items[idx].Path = shardedPath(uint64(i.ID), i.Name)
+			if err := exportFile(i, path.Join(filesDir, result.Items[idx].Path)); err != nil {
+				return fmt.Errorf("error exporting file %s [id %d]: %v", i.Name, i.ID, err)
+			}
+		}
+	}
+	out := os.Stdout
+	if filename != "-" {
+		if out, err = os.Create(filename); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
+
+// copyToStorage copies the file to the storage as the item contents
+func copyToStorage(db *gorm.DB, srcPath string, i *item) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := store.Create(db, i)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// importJSON fills the empty database and storage from the export, the files are copied from the
+// files directory of the export. Nothing is imported if it fails.
+func importJSON(filename, filesDir string) (err error) {
+	if !db.First(&item{}).RecordNotFound() || !db.First(&savedQuery{}).RecordNotFound() {
+		return errors.New("the database isn't empty")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	var exported exportedDatabase
+	err = json.NewDecoder(f).Decode(&exported)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if exported.Version != exportVersion {
+		return fmt.Errorf("unsupported export version %d", exported.Version)
+	}
+	types := map[string]itemType{}
+	for t, name := range itemTypeNames {
+		types[name] = t
+	}
+	var copied []*item
+	defer func() {
+		// runs after the rollback so the blobs of the deduplicated storage aren't referenced
+		if err == nil {
+			return
+		}
+		for _, i := range copied {
+			if err := store.Remove(i); err != nil {
+				log.Printf("Error removing copied file %s [id %d]: %v", i.Name, i.ID, err)
+			}
+		}
+	}()
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	mapping := map[id]id{}
+	newItems := make([]item, len(exported.Items))
+	for idx, e := range exported.Items {
+		t, ok := types[e.Type]
+		if !ok {
+			return fmt.Errorf("item %d has unknown type %s", e.ID, e.Type)
+		}
+		newItems[idx] = item{Name: e.Name, Type: t, TrashedAt: e.TrashedAt, CreatedAt: e.CreatedAt, Notes: e.Notes}
+		if err := tx.Create(&newItems[idx]).Error; err != nil {
+			return err
+		}
+		mapping[e.ID] = newItems[idx].ID
+	}
+	for idx, e := range exported.Items {
+		if e.Parent != 0 {
+			parent, ok := mapping[e.Parent]
+			if !ok {
+				return fmt.Errorf("parent %d of item %d not found", e.Parent, e.ID)
+			}
+			newItems[idx].ParentID = parent
+			if err := tx.Model(&newItems[idx]).Update("parent_id", parent).Error; err != nil {
+				return err
+			}
+		}
+		// the directory could be deleted, such files are restored to the root
+		if trashDir, ok := mapping[e.TrashDir]; ok {
+			newItems[idx].TrashDir = trashDir
+			if err := tx.Model(&newItems[idx]).Update("trash_dir", trashDir).Error; err != nil {
+				return err
+			}
+		}
+		for _, tagID := range e.Tags {
+			otherID, ok := mapping[tagID]
+			if !ok {
+				return fmt.Errorf("tag %d of item %d not found", tagID, e.ID)
+			}
+			if err := tx.Exec("INSERT INTO item_tags(item_id, other_id) VALUES (?, ?)", newItems[idx].ID, otherID).Error; err != nil {
+				return err
+			}
+		}
+		for _, impliedID := range e.Implies {
+			otherID, ok := mapping[impliedID]
+			if !ok {
+				return fmt.Errorf("implied tag %d of item %d not found", impliedID, e.ID)
+			}
+			if err := tx.Create(&implication{TagID: newItems[idx].ID, ImpliedID: otherID}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for idx, e := range exported.Items {
+		if newItems[idx].Type != file {
+			continue
+		}
+		copied = append(copied, &newItems[idx])
+		if err := copyToStorage(tx, path.Join(filesDir, e.Path), &newItems[idx]); err != nil {
+			return fmt.Errorf("error copying file %s [id %d]: %v", e.Name, e.ID, err)
+		}
+		var i item
+		if err := tx.Select("hash").First(&i, "id = ?", newItems[idx].ID).Error; err != nil {
+			return err
+		}
+		newItems[idx].Hash = i.Hash
+		if e.Hash != "" && i.Hash != e.Hash {
+			log.Printf("File %s [id %d] doesn't match its hash", e.Name, e.ID)
+		}
+		if e.ModifiedAt != nil {
+			// copying sets the modification time to now
+			if err := tx.Model(&item{}).Where("id = ?", newItems[idx].ID).Update("modified_at", e.ModifiedAt).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for _, q := range exported.Queries {
+		if err := tx.Create(&savedQuery{Name: q.Name, Query: q.Query}).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Printf("Imported %d items and %d queries", len(exported.Items), len(exported.Queries))
+	return nil
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,9 +18,14 @@ import (
 type (
 	filesDir struct {
 		hasTags
-		dirID   id
-		allTags bool
-		cache   *fileCache
+		dirID    id
+		allTags  bool
+		trash    bool
+		untagged bool
+		hash     string
+		search   string
+		fts      string
+		cache    *fileCache
 	}
 	filelist       map[string][]*item
 	taggedFilelist map[id]*item
@@ -29,6 +33,7 @@ type (
 
 const (
 	negativeTag = "_"
+	unionTag    = "+"
 	contentTag  = "@"
 	allTagsTag  = "@@"
 )
@@ -54,54 +59,115 @@ func (f filesDir) listFiles(name string) (*sql.Rows, error) {
 	return f.listFilesWithTags(name, false)
 }
 
-func reverseSlice(slice []interface{}) {
-	for i, j := 0, len(slice)-1; i < j; i, j = i+1, j-1 {
-		slice[i], slice[j] = slice[j], slice[i]
+func groupFilter(group tagGroup) (string, []interface{}) {
+	filter := make([]string, len(group))
+	params := make([]interface{}, len(group))
+	for i := range group {
+		filter[i] = "? IN tags"
+		params[i] = group[i]
 	}
+	if len(filter) == 1 {
+		return filter[0], params
+	}
+	return "(" + strings.Join(filter, " OR ") + ")", params
+}
+
+// flat reports if the view lists the matching items from all directories instead of one
+func (f filesDir) flat() bool {
+	return f.hash != "" || (f.untagged || !f.since.IsZero() || f.fts != "") && f.dirID == 0
+}
+
+// tagQuery combines the tag groups and query expressions of the path
+func (f filesDir) tagQuery() (andNode, error) {
+	if err := f.checkUnions(); err != nil {
+		return nil, err
+	}
+	positiveGroups, negativeGroups := f.getTagGroups()
+	result := make(andNode, 0, len(positiveGroups)+len(negativeGroups))
+	// speed up SQL because latter tags usually have much less files, also negative tags go first
+	for i := len(negativeGroups) - 1; i >= 0; i-- {
+		result = append(result, notNode{node: tagNode{names: negativeGroups[i]}})
+	}
+	for i := len(positiveGroups) - 1; i >= 0; i-- {
+		result = append(result, tagNode{names: positiveGroups[i], inherit: inheritTags})
+	}
+	for _, expr := range f.getExpressions() {
+		node, err := parseQuery(expr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, node)
+	}
+	return result, nil
 }
 
 func (f filesDir) listFilesWithTags(name string, tags bool) (*sql.Rows, error) {
-	positiveTagNames, negativeTagNames := f.getTagsWithNegative()
-	tagFilter := make([]string, 0, len(positiveTagNames)+len(negativeTagNames)+3)
-	params := make([]interface{}, 0, len(positiveTagNames)+len(negativeTagNames)+3)
+	var filter andNode
 	if f.dirID == 0 {
-		for i := range positiveTagNames {
-			tagFilter = append(tagFilter, "? IN tags")
-			params = append(params, positiveTagNames[i])
-		}
-		for i := range negativeTagNames {
-			tagFilter = append(tagFilter, "? NOT IN tags")
-			params = append(params, negativeTagNames[i])
+		tagFilter, err := f.tagQuery()
+		if err != nil {
+			return nil, err
 		}
+		filter = append(filter, tagFilter...)
 	}
-	// speed up SQL because latter tags usually have much less files
-	if len(negativeTagNames) > 0 { // only reverse SQL filter if there are negative tags, otherwise it's pointless
-		sort.Sort(sort.Reverse(sort.StringSlice(tagFilter)))
-	}
-	reverseSlice(params)
 	if name != "" {
 		matches := nameID.FindStringSubmatch(name)
 		if matches != nil {
 			id, err := strconv.ParseUint(matches[1], 10, 64)
 			if err == nil {
 				name = matches[2]
-				tagFilter = append(tagFilter, "i.id = ?")
-				params = append(params, id)
+				filter = append(filter, condition{"i.id = ?", []interface{}{id}})
 			} else {
 				log.Printf("Error parsing %s: %v", name, err)
 			}
 		}
-		tagFilter = append(tagFilter, "i.name = ?")
-		params = append(params, name)
+		filter = append(filter, nameNode{pattern: name, exact: true})
+	}
+	if !f.since.IsZero() && f.dirID == 0 {
+		filter = append(filter, condition{"i.created_at >= ?", []interface{}{f.since}})
+	}
+	if f.search != "" && f.dirID == 0 {
+		filter = append(filter, nameNode{pattern: f.search})
+	}
+	if f.fts != "" && f.dirID == 0 {
+		cond, query := ftsFilter(f.fts)
+		filter = append(filter, condition{cond, []interface{}{query}})
+	}
+	if f.untagged && f.dirID == 0 {
+		filter = append(filter, condition{query: "NOT EXISTS (SELECT 1 FROM item_tags WHERE item_id = i.id)"})
+	}
+	if f.trash {
+		filter = append(filter, condition{query: "i.trashed_at IS NOT NULL"})
+	} else {
+		filter = append(filter, condition{query: "i.trashed_at IS NULL"})
+	}
+	if f.hash != "" {
+		filter = append(filter, condition{"i.hash = ?", []interface{}{f.hash}})
+	}
+	if !f.flat() {
+		filter = append(filter, condition{"i.parent_id = ?", []interface{}{f.dirID}})
+	}
+	types := []itemType{file, dir}
+	if f.trash {
+		// trashed directories are only kept to restore the files into them
+		types = []itemType{file}
+	}
+	filter = append(filter, condition{"i.type IN (?)", []interface{}{types}})
+	where, params, err := filter.sql()
+	if err != nil {
+		return nil, err
 	}
-	tagFilter = append(tagFilter, "i.parent_id = ?", "i.type IN (?)")
-	params = append(params, f.dirID, []itemType{file, dir})
 	joinTags := " FROM items i"
 	if tags {
 		joinTags = ", t.name AS tag FROM items i LEFT JOIN item_tags it ON i.id = it.item_id LEFT JOIN items t ON t.id = it.other_id"
 	}
 	query := "WITH tags AS (SELECT name FROM item_tags LEFT JOIN items ON id = other_id WHERE item_id = i.id) " +
-		"SELECT *" + joinTags + " WHERE " + strings.Join(tagFilter, " AND ")
+		"SELECT *" + joinTags + " WHERE " + where
+	if f.fts != "" && f.dirID == 0 {
+		order, match := ftsOrder(f.fts)
+		query += " ORDER BY " + order
+		params = append(params, match)
+	}
 	rows, err := db.Raw(query, params...).Rows()
 	if err != nil {
 		return nil, err
@@ -190,6 +256,36 @@ func tagsItems(activeTagNames []string) []item {
 	return tags
 }
 
+// tagDescendants returns the tag names along with the names of all their children, including the
+// children of the included tag groups
+func tagDescendants(names []string) ([]string, error) {
+	rows, err := db.Raw("WITH RECURSIVE descendants(id, name) AS ("+
+		"SELECT id, name FROM items WHERE name IN (?) AND type = ? UNION "+
+		"SELECT i.id, i.name FROM items i, descendants d WHERE i.type = ? AND "+
+		"(i.parent_id = d.id OR i.parent_id IN (SELECT other_id FROM item_tags WHERE item_id = d.id))) "+
+		"SELECT DISTINCT name FROM descendants", names, tag, tag).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := append([]string{}, names...)
+	found := map[string]bool{}
+	for _, name := range names {
+		found[name] = true
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !found[name] {
+			found[name] = true
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
 func (f filesDir) dedupFilelist(fl filelist) []fuse.Dirent {
 	var result = emptyDirAlloc(len(fl))
 	for k := range fl {
@@ -216,6 +312,8 @@ func (f filesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	defer rows.Close()
 	fl := filelist{}
 	tfl := taggedFilelist{}
+	// the order of the rows is kept for the ranked search results
+	var order []id
 	for rows.Next() {
 		var i item
 		db.ScanRows(rows, &i)
@@ -225,6 +323,7 @@ func (f filesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			} else {
 				i.tags = append(i.tags, i.Tag)
 				tfl[i.ID] = &i
+				order = append(order, i.ID)
 			}
 		} else {
 			name := i.Name
@@ -233,8 +332,8 @@ func (f filesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	}
 	if f.allTags {
 		result := emptyDir()
-		for idx := range tfl {
-			i := tfl[idx]
+		for _, itemID := range order {
+			i := tfl[itemID]
 			name := fmt.Sprintf("|%d|%s|%s", i.ID, strings.Join(i.tags, "|"), i.Name)
 			f.cache.put(name, i)
 			result = append(result, fuse.Dirent{Inode: uint64(i.ID), Name: name, Type: i.fuseType()})
@@ -245,6 +344,16 @@ func (f filesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 }
 
 func (f filesDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (node fs.Node, handle fs.Handle, err error) {
+	if readOnly {
+		return nil, nil, syscall.EROFS
+	}
+	if f.trash || f.hash != "" || f.fts != "" {
+		return nil, nil, syscall.EACCES
+	}
+	// the new file might not match the search pattern
+	if f.hasUnions() || f.search != "" {
+		return nil, nil, syscall.EPERM
+	}
 	name, err := f.cleanupName(req.Name, false)
 	if err != nil {
 		return nil, nil, err
@@ -252,17 +361,16 @@ func (f filesDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fus
 	activeTagNames := f.getTags()
 	var tags []item
 	db.Find(&tags, "name IN (?) AND type = ?", activeTagNames, tag)
+	if tags, err = withImplied(db, tags); err != nil {
+		return nil, nil, err
+	}
 	var newItem = item{Name: name, Type: file, ParentID: f.dirID}
 	tx := db.Begin()
 	defer tx.RollbackUnlessCommitted()
 	invalidateCache()
 	tx.Create(&newItem).Association("Items").Append(tags)
 	c := content{itype: file, id: uint64(newItem.ID)}
-	path, err := c.filePathWithTx(tx)
-	if err != nil {
-		return nil, nil, err
-	}
-	file, err := os.Create(path)
+	file, err := store.Create(db, &newItem)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -271,6 +379,9 @@ func (f filesDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fus
 }
 
 func (f filesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == searchTag && f.dirID == 0 && f.search == "" {
+		return searchDir{dir: f}, nil
+	}
 	i, err := f.findFile(name)
 	if err != nil {
 		return nil, err
@@ -299,32 +410,53 @@ func (f filesDir) deleteFile(name string) error {
 		return syscall.ENOENT
 	}
 	if i.ID != 0 {
-		if i.Type == file {
-			path, err := filePath(uint64(i.ID))
-			if err != nil {
-				return err
-			}
-			if err := os.Remove(path); err != nil {
-				return err
-			}
-		} else {
+		if i.Type == file && !f.trash {
+			return trashItem(i)
+		}
+		// the directory is kept until the files trashed from it are purged
+		if i.Type == dir && !f.trash && hasTrashedItems(i.ID) {
 			if !db.Find(&item{}, "parent_id = ?", i.ID).RecordNotFound() {
 				return syscall.ENOTEMPTY
 			}
+			return trashItem(i)
 		}
-		db.Model(&i).Association("Items").Clear()
-		db.Delete(&i)
-		invalidateCache()
-		return nil
+		return deleteItem(i)
 	}
 	return syscall.ENOENT
 }
 
+// deleteItem permanently deletes the file from the storage and database or an empty directory
+func deleteItem(i *item) error {
+	if i.Type != file && !db.Find(&item{}, "parent_id = ?", i.ID).RecordNotFound() {
+		return syscall.ENOTEMPTY
+	}
+	db.Model(&i).Association("Items").Clear()
+	db.Delete(&i)
+	invalidateCache()
+	if i.Type == file {
+		return store.Remove(i)
+	}
+	return nil
+}
+
 func (f filesDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	return f.deleteFile(req.Name)
+	if readOnly {
+		return syscall.EROFS
+	}
+	if !removeGuard.allow(req.Header.Pid, f.tags) {
+		return syscall.EPERM
+	}
+	if err := f.deleteFile(req.Name); err != nil {
+		return err
+	}
+	removeGuard.deleted(req.Header.Pid, f.tags)
+	return nil
 }
 
 func (f filesDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if readOnly {
+		return syscall.EROFS
+	}
 	target, ok := newDir.(filesDir)
 	if !ok {
 		return syscall.EINVAL
@@ -340,9 +472,20 @@ func (f filesDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs
 	if srcItem == nil {
 		return syscall.ENOENT
 	}
+	if srcItem.Name == newName && target.hasUnions() {
+		return syscall.EPERM
+	}
+	if target.hash != "" || target.fts != "" || target.search != "" {
+		return syscall.EPERM
+	}
+	if target.trash {
+		if f.trash || srcItem.Type != file {
+			return syscall.EPERM
+		}
+		return trashItem(srcItem)
+	}
 	tagsNames := target.getTags()
-	tags := tagsItems(tagsNames)
-	from, err := filePath(uint64(srcItem.ID))
+	tags, err := withImplied(db, tagsItems(tagsNames))
 	if err != nil {
 		return err
 	}
@@ -352,25 +495,39 @@ func (f filesDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs
 		// which can lead to deleting the source file when moved over itself. Only delete the target
 		// if it's actually a different file.
 		if dstItem.ID != srcItem.ID {
-			target.deleteFile(newName)
+			if !removeGuard.allow(req.Header.Pid, target.tags) {
+				return syscall.EPERM
+			}
+			if err := target.deleteFile(newName); err == nil {
+				removeGuard.deleted(req.Header.Pid, target.tags)
+			}
 		}
 	}
-	rename := srcItem.Name != newName
+	parentID := target.dirID
+	if f.trash && parentID == 0 {
+		// restore the file to its directory
+		if parentID, err = restoreDir(srcItem.TrashDir); err != nil {
+			return err
+		}
+	}
+	oldName := srcItem.Name
+	rename := oldName != newName
 	srcItem.Name = newName
-	srcItem.ParentID = target.dirID
+	srcItem.ParentID = parentID
+	srcItem.TrashedAt = nil
+	srcItem.TrashDir = 0
 	tx := db.Begin()
 	defer tx.RollbackUnlessCommitted()
 	tx = tx.Save(&srcItem)
-	if !rename {
-		tx.Association("Items").Replace(tags)
-	} else {
-		to, err := filePathWithTx(tx, uint64(srcItem.ID))
-		if err != nil {
-			return err
-		}
-		if err := os.Rename(from, to); err != nil {
-			return err
+	if rename {
+		if srcItem.Type == file {
+			if err := store.Rename(srcItem, oldName); err != nil {
+				return err
+			}
 		}
+	} else if !(f.trash && len(tags) == 0) {
+		// files restored from trash to a query without tags keep their original tags
+		tx.Association("Items").Replace(tags)
 	}
 	tx.Commit()
 	invalidateCache()
@@ -378,6 +535,12 @@ func (f filesDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs
 }
 
 func (f filesDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if readOnly {
+		return nil, syscall.EROFS
+	}
+	if f.trash || f.hash != "" || f.fts != "" || f.search != "" || f.hasUnions() {
+		return nil, syscall.EPERM
+	}
 	name, err := f.cleanupName(req.Name, false)
 	if err != nil {
 		return nil, syscall.EINVAL
@@ -388,12 +551,15 @@ func (f filesDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, e
 	if !db.First(&parentDir, "id = ?", f.dirID).RecordNotFound() {
 		parentID = parentDir.ID
 	}
-	result := filesDir{hasTags{tags: f.tags}, 0, false, newCache()}
+	result := filesDir{hasTags: hasTags{tags: f.tags}, cache: newCache()}
 	newDir := item{ID: 0, Name: name, Type: dir, ParentID: parentID}
 	var tags []item
 	if db.Find(&tags, "name IN (?) AND type = ?", tagsNames, tag).RecordNotFound() {
 		return nil, syscall.ENOENT
 	}
+	if tags, err = withImplied(db, tags); err != nil {
+		return nil, err
+	}
 	tx := db.Begin()
 	defer tx.RollbackUnlessCommitted()
 	if err := tx.Create(&newDir).Association("Items").Replace(&tags).Error; err != nil {
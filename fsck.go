@@ -2,13 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 )
 
@@ -24,54 +22,77 @@ func newPassPrinter() func(title string) {
 	}
 }
 
-func moveFile(srcFilename, dstFilename string) error {
-	return exec.Command("mv", srcFilename, dstFilename).Run()
+// recoverFile moves the lost file from the storage to the directory on the mounted filesystem
+func recoverFile(src, dstDir string) (string, error) {
+	name, r, err := store.OpenLost(src)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	dst := path.Join(dstDir, name)
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return dst, os.Remove(src)
 }
 
 func fixFilename(itemID uint64) error {
 	var i item
 	tx := db.Begin()
 	defer tx.RollbackUnlessCommitted()
-	tx.First(&i, "id = ?", itemID)
-	i.Name = strings.ReplaceAll(i.Name, "|", "\u00a6")
-	path, err := filePathWithTx(tx, itemID)
-	if err != nil {
-		return fmt.Errorf("error getting path of file with id = %d: %s", itemID, err)
+	if tx.First(&i, "id = ?", itemID).RecordNotFound() {
+		return fmt.Errorf("file with id = %d not found", itemID)
 	}
-	fn := strings.ReplaceAll(filepath.Base(path), "|", "\u00a6")
-	newPath := filepath.Join(filepath.Dir(path), fn)
-	if err := os.Rename(path, newPath); err != nil {
-		return fmt.Errorf("error renaming %s => %s: %s", path, newPath, err)
+	oldName := i.Name
+	i.Name = strings.ReplaceAll(i.Name, "|", "\u00a6")
+	if err := store.Rename(&i, oldName); err != nil {
+		return fmt.Errorf("error renaming %s => %s: %s", oldName, i.Name, err)
 	}
-	log.Printf("Renamed %s => %s", path, newPath)
+	log.Printf("Renamed %s => %s", oldName, i.Name)
 	tx.Save(&i)
 	tx.Commit()
+	invalidateCache()
 	return nil
 }
 
-func fsck(fix bool) error {
+func fsck(fix bool, verifyHashes bool) error {
 	var errors, fixed int
 	pass := newPassPrinter()
 	pass("checking database")
-	rows, err := db.Model(&item{}).Where("type = ?", file).Select("id, name").Rows()
+	rows, err := db.Model(&item{}).Where("type = ?", file).Select("id, name, hash").Rows()
 	if err != nil {
 		return err
 	}
 	var badIDs []id
+	var corrupted int
 	for rows.Next() {
 		var i item
 		db.ScanRows(rows, &i)
-		path, err := filePathWithNameTx(uint64(i.ID), i.Name)
-		if err != nil {
-			return err
-		}
-		_, err = os.Stat(path)
+		_, err = store.Stat(&i)
 		if os.IsNotExist(err) {
-			log.Printf("File %s doesn't exist but is present in the database", path)
+			log.Printf("File %s [id %d] doesn't exist but is present in the database", i.Name, i.ID)
 			badIDs = append(badIDs, i.ID)
+			continue
+		}
+		if verifyHashes && i.Hash != "" {
+			hash, err := hashItem(&i)
+			if err != nil {
+				log.Printf("Error hashing file %s [id %d]: %v", i.Name, i.ID, err)
+			} else if hash != i.Hash {
+				log.Printf("File %s [id %d] is corrupted, its hash is %s but should be %s", i.Name, i.ID, hash, i.Hash)
+				corrupted++
+			}
 		}
 	}
-	errors += len(badIDs)
+	errors += len(badIDs) + corrupted
 	if fix && len(badIDs) > 0 {
 		pass("removing incorrect database entries")
 		log.Printf("Deleting %d file records from the database...", len(badIDs))
@@ -95,39 +116,13 @@ func fsck(fix bool) error {
 	var lostFiles []string
 	var badFiles []uint64
 	pass("checking storage")
-	filepath.Walk(storagePath, func(path string, info os.FileInfo, _ error) error {
-		if info.IsDir() {
-			return nil
-		}
-		rel, err := filepath.Rel(storagePath, path)
-		if err != nil {
-			return err
-		}
-		if rel == "version.txt" {
-			return nil
-		}
-		match := filenameRegex.FindStringSubmatch(info.Name())
-		if match == nil {
-			log.Printf("Bad filename %s", path)
+	store.Walk(func(path string, i *item) error {
+		if i == nil {
 			lostFiles = append(lostFiles, path)
 			return nil
 		}
-		dir := filepath.Dir(rel)
-		id6, id2 := filepath.Split(dir)
-		id6 = filepath.Base(id6)
-		if len(id6) != 6 || len(id2) != 2 || !strings.HasPrefix(match[1], id6+id2) {
-			lostFiles = append(lostFiles, path)
-			log.Printf("Invalid path %s/%s != %s", id6, id2, match[1])
-			return nil
-		}
-		var i item
-		if db.First(&i, "id = ? AND name = ?", match[1], match[2]).RecordNotFound() {
-			lostFiles = append(lostFiles, path)
-			log.Printf("File %s is in storage but not in database", path)
-		}
-		if strings.Contains(info.Name(), "|") {
-			fileID, _ := strconv.ParseUint(match[1], 10, 64)
-			badFiles = append(badFiles, fileID)
+		if strings.Contains(i.Name, "|") {
+			badFiles = append(badFiles, uint64(i.ID))
 			log.Printf("File %s name contains invalid characters", path)
 		}
 		return nil
@@ -146,13 +141,12 @@ func fsck(fix bool) error {
 		}
 		lfbrowse := path.Join(mountpoint, "browse", "lost+found", "@")
 		for _, src := range lostFiles {
-			dst := path.Join(lfbrowse, filepath.Base(src))
-			log.Printf("Recovering %s to %s...", src, dst)
-			err := moveFile(src, dst)
+			log.Printf("Recovering %s...", src)
+			dst, err := recoverFile(src, lfbrowse)
 			if err != nil {
 				log.Printf("Error recovering file %s: %s", src, err)
 			} else {
-				log.Printf("Recovered file %s to lost+found", src)
+				log.Printf("Recovered file %s to %s", src, dst)
 				fixed++
 			}
 		}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// The full-text index of the file names, tags and notes is kept in sync with the items by the
+// triggers. SQLite only supports FTS5 when built with the sqlite_fts5 tag, without it the search
+// is disabled.
+
+const ftsTable = "items_fts"
+
+var ftsAvailable bool
+
+// ftsTags is the comma separated list of the tags of the file
+func ftsTags(itemID string) string {
+	return fmt.Sprintf("(SELECT COALESCE(group_concat(t.name, ', '), '') FROM item_tags it JOIN items t ON t.id = it.other_id "+
+		"WHERE it.item_id = %s AND t.type = %d)", itemID, tag)
+}
+
+var ftsTriggers = map[string]string{
+	"items_fts_insert": fmt.Sprintf("AFTER INSERT ON items WHEN new.type IN (%d, %d) BEGIN "+
+		"INSERT INTO items_fts(rowid, name, tags, notes) VALUES (new.id, new.name, '', new.notes); END", file, dir),
+	"items_fts_update": fmt.Sprintf("AFTER UPDATE OF name, notes ON items WHEN new.type IN (%d, %d) BEGIN "+
+		"UPDATE items_fts SET name = new.name, notes = new.notes WHERE rowid = new.id; END", file, dir),
+	"items_fts_rename_tag": fmt.Sprintf("AFTER UPDATE OF name ON items WHEN new.type = %d BEGIN "+
+		"UPDATE items_fts SET tags = %s WHERE rowid IN (SELECT item_id FROM item_tags WHERE other_id = new.id); END",
+		tag, ftsTags("items_fts.rowid")),
+	"items_fts_delete": "AFTER DELETE ON items BEGIN DELETE FROM items_fts WHERE rowid = old.id; END",
+	"item_tags_fts_insert": "AFTER INSERT ON item_tags BEGIN " +
+		"UPDATE items_fts SET tags = " + ftsTags("new.item_id") + " WHERE rowid = new.item_id; END",
+	"item_tags_fts_delete": "AFTER DELETE ON item_tags BEGIN " +
+		"UPDATE items_fts SET tags = " + ftsTags("old.item_id") + " WHERE rowid = old.item_id; END",
+}
+
+// setupFTS creates the index and its triggers if they're missing and fills it. If FTS5 isn't
+// supported the triggers are dropped so the database can still be changed.
+func setupFTS() error {
+	// the errors are expected so they're not logged by gorm, the existing table is only checked for
+	// the module when it's used
+	_, err := db.DB().Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + ftsTable + " USING fts5(name, tags, notes)")
+	if err == nil {
+		_, err = db.DB().Exec("SELECT rowid FROM " + ftsTable + " LIMIT 0")
+	}
+	if err != nil {
+		log.Printf("Full-text search is disabled (%v), build with -tags sqlite_fts5 to enable it", err)
+		for name := range ftsTriggers {
+			if err := db.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ftsAvailable = true
+	var count int
+	if err := db.Table("sqlite_master").Where("type = 'trigger' AND name IN (?)", ftsTriggerNames()).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == len(ftsTriggers) {
+		return nil
+	}
+	// the index is outdated if the database was changed without the triggers
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	for name, trigger := range ftsTriggers {
+		if err := tx.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("CREATE TRIGGER " + name + " " + trigger).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Exec("DELETE FROM " + ftsTable).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("INSERT INTO "+ftsTable+"(rowid, name, tags, notes) SELECT id, name, "+ftsTags("i.id")+", notes "+
+		"FROM items i WHERE type IN (?)", []itemType{file, dir}).Error; err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func ftsTriggerNames() []string {
+	result := make([]string, 0, len(ftsTriggers))
+	for name := range ftsTriggers {
+		result = append(result, name)
+	}
+	return result
+}
+
+var ftsColumn = regexp.MustCompile(`^(name|tags|notes):(.+)`)
+
+// ftsQuery turns the search terms into an FTS5 query that matches the items containing all of
+// them. The terms are matched as is, a trailing * matches the prefix and name:, tags: or notes:
+// limits the term to that column.
+func ftsQuery(terms []string) string {
+	var result []string
+	for _, term := range terms {
+		for _, word := range strings.Fields(term) {
+			column := ""
+			if m := ftsColumn.FindStringSubmatch(word); m != nil {
+				column, word = m[1]+" : ", m[2]
+			}
+			prefix := ""
+			if strings.HasSuffix(word, "*") {
+				word, prefix = strings.TrimRight(word, "*"), "*"
+			}
+			if word == "" {
+				continue
+			}
+			result = append(result, column+`"`+strings.ReplaceAll(word, `"`, `""`)+`"`+prefix)
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// ftsFilter selects the files matching the FTS5 query
+func ftsFilter(query string) (string, interface{}) {
+	return "i.id IN (SELECT rowid FROM " + ftsTable + " WHERE " + ftsTable + " MATCH ?)", query
+}
+
+// ftsOrder sorts the files matching the FTS5 query by relevance, the best matches first
+func ftsOrder(query string) (string, interface{}) {
+	return "(SELECT bm25(" + ftsTable + ") FROM " + ftsTable + " WHERE " + ftsTable + " MATCH ? AND rowid = i.id)", query
+}
+
+// ftsDir contains the files matching the search terms used as the directory name
+type ftsDir struct{}
+
+func (s ftsDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0755
+	attr.Size = 4096
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func (s ftsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return emptyDir(), nil
+}
+
+func (s ftsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	query := ftsQuery([]string{name})
+	if !ftsAvailable || query == "" {
+		return nil, syscall.ENOENT
+	}
+	return filesDir{allTags: true, fts: query, cache: newCache()}, nil
+}
+
+func (s ftsDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return nil, nil, syscall.EACCES
+}
+
+// searchCommand prints the files matching the terms, the best matches first
+func searchCommand(terms []string) error {
+	if !ftsAvailable {
+		return errors.New("full-text search is not supported by this build")
+	}
+	query := ftsQuery(terms)
+	if query == "" {
+		return errors.New("nothing to search for")
+	}
+	rows, err := db.Raw("SELECT i.id, i.name, "+ftsTable+".tags FROM "+ftsTable+" JOIN items i ON i.id = "+ftsTable+".rowid "+
+		"WHERE "+ftsTable+" MATCH ? AND i.trashed_at IS NULL ORDER BY bm25("+ftsTable+")", query).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			itemID     id
+			name, tags string
+		)
+		if err := rows.Scan(&itemID, &name, &tags); err != nil {
+			return err
+		}
+		fmt.Printf("%d\t%s\t%s\n", itemID, name, tags)
+	}
+	return rows.Err()
+}
+
+// noteCommand replaces the notes of the file if set is true or prints them
+func noteCommand(file, notes string, set bool) error {
+	itemID, err := findItemID(file)
+	if err != nil {
+		return err
+	}
+	if !set {
+		var i item
+		db.Select("notes").First(&i, "id = ?", itemID)
+		if i.Notes != "" {
+			fmt.Println(i.Notes)
+		}
+		return nil
+	}
+	return setNotes(itemID, notes)
+}
@@ -6,5 +6,5 @@ require (
 	bazil.org/fuse v0.0.0-20200524192727-fb710f7dfd05
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
 	github.com/jinzhu/gorm v1.9.16
-	golang.org/x/sys v0.0.0-20201126233918-771906719818 // indirect
+	golang.org/x/crypto v0.14.0
 )
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type deleteEvent struct {
+	time time.Time
+	tags string
+}
+
+// deleteGuard stops processes that delete too many files from different tag combinations in a short
+// time which is what file managers do when deleting a directory in browse recursively
+type deleteGuard struct {
+	sync.Mutex
+	limit   int
+	window  time.Duration
+	events  map[uint32][]deleteEvent
+	blocked map[uint32]time.Time
+}
+
+var removeGuard = newDeleteGuard(0, 0)
+
+func newDeleteGuard(limit int, window time.Duration) *deleteGuard {
+	return &deleteGuard{limit: limit, window: window, events: map[uint32][]deleteEvent{}, blocked: map[uint32]time.Time{}}
+}
+
+func (g *deleteGuard) cleanup(now time.Time) {
+	for pid, events := range g.events {
+		if now.Sub(events[len(events)-1].time) > g.window {
+			delete(g.events, pid)
+		}
+	}
+	for pid, until := range g.blocked {
+		if now.After(until) {
+			delete(g.blocked, pid)
+		}
+	}
+}
+
+// threadGroup returns the process ID of the thread, FUSE requests only carry the thread ID so the
+// threads of one process would be counted separately
+func threadGroup(tid uint32) uint32 {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return tid
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "Tgid:") {
+			if tgid, err := strconv.ParseUint(strings.TrimSpace(line[len("Tgid:"):]), 10, 32); err == nil {
+				return uint32(tgid)
+			}
+			break
+		}
+	}
+	return tid
+}
+
+// recent returns the deletions of the process within the window
+func (g *deleteGuard) recent(pid uint32, now time.Time) []deleteEvent {
+	var events []deleteEvent
+	for _, e := range g.events[pid] {
+		if now.Sub(e.time) <= g.window {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// allow reports if the thread's process may delete a file from the tag combination, blocked
+// processes stay blocked until they stop deleting for the whole window
+func (g *deleteGuard) allow(tid uint32, tags string) bool {
+	if g.limit <= 0 {
+		return true
+	}
+	pid := threadGroup(tid)
+	g.Lock()
+	defer g.Unlock()
+	now := time.Now()
+	g.cleanup(now)
+	if _, ok := g.blocked[pid]; ok {
+		g.blocked[pid] = now.Add(g.window)
+		return false
+	}
+	events := append(g.recent(pid, now), deleteEvent{time: now, tags: tags})
+	paths := map[string]struct{}{}
+	for _, e := range events {
+		paths[e.tags] = struct{}{}
+	}
+	if len(events) > g.limit && len(paths) > 1 {
+		log.Printf("Process %d deleted %d files from %d tag combinations in %s, blocking further deletions", pid, len(events)-1, len(paths), g.window)
+		delete(g.events, pid)
+		g.blocked[pid] = now.Add(g.window)
+		return false
+	}
+	return true
+}
+
+// deleted records the successful deletion allowed before
+func (g *deleteGuard) deleted(tid uint32, tags string) {
+	if g.limit <= 0 {
+		return
+	}
+	pid := threadGroup(tid)
+	g.Lock()
+	defer g.Unlock()
+	now := time.Now()
+	g.events[pid] = append(g.recent(pid, now), deleteEvent{time: now, tags: tags})
+}
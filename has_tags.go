@@ -2,13 +2,26 @@ package main
 
 import (
 	"os"
+	"path"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type hasTags struct {
 	tags string
+	// only the items created after this time are shown if set
+	since time.Time
 }
 
+func (h hasTags) join(name string) hasTags {
+	h.tags = path.Join(h.tags, name)
+	return h
+}
+
+// tagGroup is a set of tags joined with OR, groups are joined with AND
+type tagGroup []string
+
 func (h hasTags) getAllTags() []string {
 	result := strings.Split(h.tags, string(os.PathSeparator))
 	if result[len(result)-1] == contentTag || result[len(result)-1] == allTagsTag {
@@ -17,28 +30,88 @@ func (h hasTags) getAllTags() []string {
 	return result
 }
 
-func (h hasTags) getTagsWithNegative() (positive []string, negative []string) {
+func (h hasTags) getTagGroups() (positive []tagGroup, negative []tagGroup) {
 	allTags := h.getAllTags()
 	nextIsNegative := false
+	nextIsUnion := false
+	var last *[]tagGroup
 	for _, tag := range allTags {
-		if nextIsNegative {
-			if tag != "" {
-				negative = append(negative, tag)
-			}
+		switch {
+		case tag == "":
+		case strings.HasPrefix(tag, queryPrefix):
+			// expressions can't be united with tags
 			nextIsNegative = false
-		} else {
-			if tag == negativeTag {
-				nextIsNegative = true
-			} else {
-				if tag != "" {
-					positive = append(positive, tag)
-				}
-			}
+			nextIsUnion = false
+			last = nil
+		case tag == negativeTag:
+			nextIsNegative = true
+		case tag == unionTag:
+			nextIsUnion = true
+		case nextIsUnion && last != nil:
+			(*last)[len(*last)-1] = append((*last)[len(*last)-1], tag)
+			nextIsUnion = false
+			nextIsNegative = false
+		case nextIsNegative:
+			negative = append(negative, tagGroup{tag})
+			last = &negative
+			nextIsNegative = false
+			nextIsUnion = false
+		default:
+			positive = append(positive, tagGroup{tag})
+			last = &positive
+			nextIsUnion = false
+		}
+	}
+	return
+}
+
+func flattenGroups(groups []tagGroup) (result []string) {
+	for _, g := range groups {
+		result = append(result, g...)
+	}
+	return
+}
+
+func (h hasTags) getTagsWithNegative() (positive []string, negative []string) {
+	positiveGroups, negativeGroups := h.getTagGroups()
+	return flattenGroups(positiveGroups), flattenGroups(negativeGroups)
+}
+
+// getExpressions returns the query expressions without the prefix
+func (h hasTags) getExpressions() (result []string) {
+	for _, name := range h.getAllTags() {
+		if strings.HasPrefix(name, queryPrefix) {
+			result = append(result, strings.TrimPrefix(name, queryPrefix))
 		}
 	}
 	return
 }
 
+// checkUnions fails if the path unites an expression with tags, the expression should use or instead
+func (h hasTags) checkUnions() error {
+	allTags := h.getAllTags()
+	for i := 1; i < len(allTags); i++ {
+		if allTags[i] == unionTag && strings.HasPrefix(allTags[i-1], queryPrefix) {
+			return syscall.EINVAL
+		}
+	}
+	return nil
+}
+
+// hasUnions reports if the tag set is ambiguous and can't be assigned to a file
+func (h hasTags) hasUnions() bool {
+	if len(h.getExpressions()) > 0 {
+		return true
+	}
+	positive, _ := h.getTagGroups()
+	for _, g := range positive {
+		if len(g) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
 func (h hasTags) getTags() []string {
 	result, _ := h.getTagsWithNegative()
 	return result
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+func hashItem(i *item) (string, error) {
+	f, err := store.Open(i, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// setHash updates the hash, size and modification time of the file after it was written
+func setHash(db *gorm.DB, itemID id, hash string) error {
+	updates := map[string]interface{}{"hash": hash, "modified_at": time.Now()}
+	var i item
+	if !db.Select("id, name").First(&i, "id = ?", itemID).RecordNotFound() {
+		i.Hash = hash
+		if fi, err := store.Stat(&i); err == nil {
+			updates["size"] = fi.Size()
+		}
+	}
+	if err := db.Model(&item{}).Where("id = ?", itemID).Updates(updates).Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+func updateHash(db *gorm.DB, itemID id, path string) error {
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	return setHash(db, itemID, hash)
+}
+
+// migrateHashes calculates the missing hashes of the files stored before hashing was introduced
+func migrateHashes() error {
+	var items []item
+	if err := db.Select("id, name, hash").Find(&items, "type = ? AND (hash IS NULL OR hash = '')", file).Error; err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	log.Printf("Calculating hashes of %d files...", len(items))
+	for i := range items {
+		hash, err := hashItem(&items[i])
+		if err != nil {
+			log.Printf("Error hashing file %s [id %d]: %v", items[i].Name, items[i].ID, err)
+			continue
+		}
+		db.Model(&item{}).Where("id = ?", items[i].ID).Update("hash", hash)
+	}
+	log.Println("Done.")
+	return nil
+}
+
+// migrateSizes sets the sizes of the files stored before they were tracked
+func migrateSizes() error {
+	var items []item
+	if err := db.Select("id, name, hash").Find(&items, "type = ? AND size IS NULL", file).Error; err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	log.Printf("Setting sizes of %d files...", len(items))
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	for i := range items {
+		fi, err := store.Stat(&items[i])
+		if err != nil {
+			log.Printf("Error getting the size of %s [id %d]: %v", items[i].Name, items[i].ID, err)
+			continue
+		}
+		if err := tx.Model(&item{}).Where("id = ?", items[i].ID).Update("size", fi.Size()).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Println("Done.")
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// implication makes files tagged with the tag also get the implied tag, like cats => animals
+type implication struct {
+	ID        id
+	TagID     id `gorm:"index"`
+	ImpliedID id
+}
+
+// withImplied adds all tags implied by the tags directly or through other implications
+func withImplied(db *gorm.DB, tags []item) ([]item, error) {
+	if len(tags) == 0 {
+		return tags, nil
+	}
+	ids := make([]id, len(tags))
+	for i := range tags {
+		ids[i] = tags[i].ID
+	}
+	var implied []item
+	if err := db.Raw("WITH RECURSIVE implied(id) AS (SELECT id FROM items WHERE id IN (?) UNION "+
+		"SELECT im.implied_id FROM implications im, implied WHERE im.tag_id = implied.id) "+
+		"SELECT * FROM items WHERE id IN implied AND id NOT IN (?) AND type = ?", ids, ids, tag).Scan(&implied).Error; err != nil {
+		return nil, err
+	}
+	return append(tags, implied...), nil
+}
+
+func findTag(name string) (*item, error) {
+	t, ok := canonicalTag(name)
+	if !ok {
+		return nil, fmt.Errorf("tag %s not found", name)
+	}
+	return t, nil
+}
+
+func addImplication(tagName, impliedName string) error {
+	t, err := findTag(tagName)
+	if err != nil {
+		return err
+	}
+	implied, err := findTag(impliedName)
+	if err != nil {
+		return err
+	}
+	if t.ID == implied.ID {
+		return errors.New("a tag can't imply itself")
+	}
+	if !db.First(&implication{}, "tag_id = ? AND implied_id = ?", t.ID, implied.ID).RecordNotFound() {
+		return nil
+	}
+	return db.Create(&implication{TagID: t.ID, ImpliedID: implied.ID}).Error
+}
+
+func removeImplication(tagName, impliedName string) error {
+	t, err := findTag(tagName)
+	if err != nil {
+		return err
+	}
+	implied, err := findTag(impliedName)
+	if err != nil {
+		return err
+	}
+	if db.Delete(&implication{}, "tag_id = ? AND implied_id = ?", t.ID, implied.ID).RowsAffected == 0 {
+		return fmt.Errorf("%s doesn't imply %s", tagName, impliedName)
+	}
+	return nil
+}
+
+func listImplications() error {
+	rows, err := db.Raw("SELECT t.name, i.name FROM implications im JOIN items t ON t.id = im.tag_id " +
+		"JOIN items i ON i.id = im.implied_id ORDER BY t.name, i.name").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tagName, impliedName string
+		if err := rows.Scan(&tagName, &impliedName); err != nil {
+			return err
+		}
+		fmt.Printf("%s => %s\n", tagName, impliedName)
+	}
+	return rows.Err()
+}
+
+// applyImplications adds the implied tags to all existing files and directories
+func applyImplications() error {
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	var added int64
+	for {
+		// repeat until the implications of the implied tags are applied too
+		res := tx.Exec("INSERT INTO item_tags(item_id, other_id) SELECT DISTINCT it.item_id, im.implied_id "+
+			"FROM item_tags it JOIN implications im ON im.tag_id = it.other_id "+
+			"JOIN items i ON i.id = it.item_id AND i.type IN (?) WHERE NOT EXISTS "+
+			"(SELECT 1 FROM item_tags e WHERE e.item_id = it.item_id AND e.other_id = im.implied_id)", []itemType{file, dir})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			break
+		}
+		added += res.RowsAffected
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	log.Printf("Added %d implied tags", added)
+	return nil
+}
@@ -66,7 +66,7 @@ func importTags(tagspath string) error {
 	return nil
 }
 
-func copyStorageFile(storage, srcIDStr, srcFilename string, id uint64) error {
+func copyStorageFile(storage, srcIDStr, srcFilename string, itemID id) error {
 	srcID, err := strconv.ParseInt(srcIDStr, 10, 64)
 	if err != nil {
 		return err
@@ -76,17 +76,15 @@ func copyStorageFile(storage, srcIDStr, srcFilename string, id uint64) error {
 		return err
 	}
 	defer src.Close()
-	dstPath, err := filePath(id)
+	dst, err := store.Create(db, &item{ID: itemID, Name: srcFilename})
 	if err != nil {
 		return err
 	}
-	dst, err := os.Create(dstPath)
-	if err != nil {
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
 		return err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
-	return err
+	return dst.Close()
 }
 
 func importData(datapath, storage string) error {
@@ -106,9 +104,9 @@ func importData(datapath, storage string) error {
 			if err != nil {
 				return err
 			}
-			id, _ := res.LastInsertId()
-			mapping[match[1]] = id
-			if err := copyStorageFile(storage, match[1], filename, uint64(id)); err != nil {
+			itemID, _ := res.LastInsertId()
+			mapping[match[1]] = itemID
+			if err := copyStorageFile(storage, match[1], filename, id(itemID)); err != nil {
 				log.Printf("Error migrating file %s [id %s]: %v", filename, match[1], err)
 			}
 		}
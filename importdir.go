@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+type importedFile struct {
+	src  string
+	item item
+}
+
+// validTagName reports if the directory name can be used as a tag name
+func validTagName(name string) bool {
+	switch name {
+	case contentTag, allTagsTag, negativeTag, unionTag:
+		return false
+	}
+	return name != "" && isValidName(name) && !strings.HasPrefix(name, "!") && !strings.Contains(name, "/")
+}
+
+// importTag finds the tag by name or alias or creates it under the parent
+func importTag(tx *gorm.DB, tags map[string]*item, name string, parentID id) (*item, error) {
+	if t, ok := tags[name]; ok {
+		return t, nil
+	}
+	var t, a item
+	found := !tx.First(&t, "name = ? AND type = ?", name, tag).RecordNotFound() ||
+		!tx.First(&a, "name = ? AND type = ?", name, alias).RecordNotFound() &&
+			!tx.First(&t, "id = ? AND type = ?", a.ParentID, tag).RecordNotFound()
+	if !found {
+		t = item{Name: name, Type: tag, ParentID: parentID}
+		if err := tx.Create(&t).Error; err != nil {
+			return nil, err
+		}
+		log.Printf("Created tag %s", name)
+	}
+	tags[name] = &t
+	return &t, nil
+}
+
+// collectFiles creates the items for all files in the directory tree tagged with their path components
+func collectFiles(tx *gorm.DB, root string, parentID id) ([]importedFile, error) {
+	var result []importedFile
+	tags := map[string]*item{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if !isValidName(info.Name()) {
+			log.Printf("Skipping %s, file names can't contain |", p)
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		var fileTags []item
+		for _, name := range strings.Split(filepath.Dir(rel), string(os.PathSeparator)) {
+			if name == "." {
+				continue
+			}
+			if !validTagName(name) {
+				log.Printf("Directory name %s can't be a tag, ignored for %s", name, p)
+				continue
+			}
+			t, err := importTag(tx, tags, name, parentID)
+			if err != nil {
+				return err
+			}
+			fileTags = append(fileTags, *t)
+		}
+		if fileTags, err = withImplied(tx, fileTags); err != nil {
+			return err
+		}
+		f := importedFile{src: p, item: item{Name: info.Name(), Type: file}}
+		if err := tx.Create(&f.item).Association("Items").Append(fileTags).Error; err != nil {
+			return err
+		}
+		result = append(result, f)
+		return nil
+	})
+	return result, err
+}
+
+// importDir adds the files from the directory tree tagging them with the names of the directories
+// they're in, missing tags are created under parent. Nothing is imported if any file fails and the
+// moved files are only removed after the import is finished.
+func importDir(root string, parent string, move bool) (err error) {
+	var parentID id
+	if parent != "" {
+		var p item
+		if db.First(&p, "name = ? AND type = ?", parent, tag).RecordNotFound() {
+			return fmt.Errorf("parent tag %s not found", parent)
+		}
+		parentID = p.ID
+	}
+	var copied []*item
+	defer func() {
+		// runs after the rollback so the blobs of the deduplicated storage aren't referenced
+		if err == nil {
+			return
+		}
+		for _, i := range copied {
+			if err := store.Remove(i); err != nil {
+				log.Printf("Error removing copied file %s [id %d]: %v", i.Name, i.ID, err)
+			}
+		}
+	}()
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	files, err := collectFiles(tx, root, parentID)
+	if err != nil {
+		return err
+	}
+	for idx := range files {
+		f := &files[idx]
+		copied = append(copied, &f.item)
+		if err := copyToStorage(tx, f.src, &f.item); err != nil {
+			return fmt.Errorf("error importing %s: %v", f.src, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	if move {
+		for _, f := range files {
+			if err := os.Remove(f.src); err != nil {
+				log.Printf("Error removing %s: %v", f.src, err)
+			}
+		}
+	}
+	log.Printf("Imported %d files", len(files))
+	return nil
+}
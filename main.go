@@ -26,6 +26,8 @@ var (
 	gid         uint32
 	storagePath string
 	mountpoint  string
+	inheritTags bool
+	readOnly    bool
 )
 
 func parseUserAndSet(uidgid []string) {
@@ -55,9 +57,28 @@ func setUIDGID(uidgid string) {
 }
 
 const usage = `Usage:
-	memetagfs [-v] [-s storage] [-d database.db] [-u uid:gid] [-p] [--logcache] [--logfuse string] <mountpoint>
-	memetagfs [-d database.db] [-s storage] -i -t tags.sql -c data.sql -r storage
-	memetagfs -d database.db -s storage --fsck [-f] [-p] [-v] <mountpoint>
+	memetagfs [-v] [-s storage] [-d database.db] [-u uid:gid] [-k keyfile] [-p] [--readonly] [--dedup] [--inherit] [--trash-days days] [--delete-limit n] [--delete-window sec] [--logcache] [--logfuse string] <mountpoint>
+	memetagfs [-d database.db] [-s storage] [-k keyfile] --purge-trash --trash-days days
+	memetagfs [-d database.db] [-s storage] [-k keyfile] -i -t tags.sql -c data.sql -r storage
+	memetagfs [-d database.db] [-s storage] [-k keyfile] --import-dir dir [--tag-parent tag] [--move]
+	memetagfs [-d database.db] [-s storage] [-k keyfile] import-tmsu <tmsudb> [--tmsu-values mode]
+	memetagfs [-d database.db] [-s storage] [-k keyfile] import-sidecars <dir> [--tag-map file] [--unmapped mode] [--move]
+	memetagfs [-d database.db] [-s storage] [-k keyfile] export <json> <filesdir>
+	memetagfs [-d database.db] [-s storage] [-k keyfile] import <json> <filesdir>
+	memetagfs [-d database.db] tag (add|rm) <file> <tags>...
+	memetagfs [-d database.db] ls <query>
+	memetagfs [-d database.db] mktag <tag>
+	memetagfs [-d database.db] mvtag <tag> <newtag>
+	memetagfs [-d database.db] merge-tag <tag> <dsttag>
+	memetagfs [-d database.db] rmtag <tag> [--replace tag | --allow-untagged]
+	memetagfs [-d database.db] imply (add|rm) <tag> <implied>
+	memetagfs [-d database.db] imply (ls|apply)
+	memetagfs [-d database.db] search <terms>...
+	memetagfs [-d database.db] note <file> [<notes>]
+	memetagfs [-d database.db] query set <name> <query>
+	memetagfs [-d database.db] query rm <name>
+	memetagfs [-d database.db] query ls
+	memetagfs -d database.db -s storage --fsck [-f] [--hashes] [-k keyfile] [-p] [-v] <mountpoint>
 	memetagfs -h
 
 Options:
@@ -65,11 +86,28 @@ Options:
 	-d --database database  Path to the database [default: fs.db]
 	-p --prof               Run a webserver to profile the binary
 	-u uid:gid              Use this uid and gid for files instead of current user
+	--readonly              Mount read-only, no files or tags can be changed
+	--dedup                 Convert the storage to store identical files only once
+	-k --keyfile keyfile    Encrypt the storage with the passphrase from this file, - reads it from stdin
+	--inherit               Positive tags in queries also match files tagged with their child tags
 	-i                      Import H2 database from jtagsfs
 	-t tags.sql             tags.sql file from jtagsfs
 	-c data.sql             data.sql file from jtagsfs
 	-r storage              storage from jtagsfs
+	--import-dir dir        Import the files from the directory tree tagged with the directory names
+	--tag-parent tag        Create the missing tags for --import-dir under this tag
+	--move                  Move the imported files to the storage instead of copying
+	--tmsu-values mode      Import TMSU tag values as child tags of the tag (child) or as tag=value tags (flat) [default: child]
+	--tag-map file          Map the sidecar tags to the existing tags with lines like "sidecar_tag = tag"
+	--unmapped mode         Create the unknown sidecar tags under "imported" (create) or ignore them (drop) [default: create]
+	--replace tag           Replace the deleted tag with this tag in all files
+	--allow-untagged        Delete the tag even if some files are left without tags
 	--fsck                  Check the database and storage for errors and try to fix them
+	--purge-trash           Permanently delete the trashed files
+	--trash-days days       Purge the files trashed more than this number of days ago, 0 purges all
+	--delete-limit n        Max deletions per process from different tag combinations, 0 disables [default: 50]
+	--delete-window sec     Time window in seconds for --delete-limit [default: 10]
+	--hashes                Also verify the file contents against the stored hashes
 	-f                      Fix the errors in the database and storage
 	-v --verbose            Verbose logging
 	--logcache              Display internal cache events and effectiveness
@@ -89,6 +127,8 @@ func main() {
 		setUIDGID("")
 	}
 	logCache = opts["--logcache"].(bool)
+	inheritTags, _ = opts.Bool("--inherit")
+	readOnly, _ = opts.Bool("--readonly")
 	dbPath, _ := opts.String("--database")
 	db, err = gorm.Open("sqlite3", dbPath)
 	if err != nil {
@@ -106,25 +146,117 @@ func main() {
 			}
 		}
 	}
-	db.AutoMigrate(item{})
+	db.AutoMigrate(item{}, implication{}, migration{}, savedQuery{})
+	if err := setupFTS(); err != nil {
+		log.Fatal(err)
+	}
+	if ok, err := runCommand(opts); ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if p, _ := opts.Bool("--prof"); p {
 		go func() {
 			log.Println(http.ListenAndServe("localhost:6060", nil))
 		}()
 	}
+	dedup, _ := opts.Bool("--dedup")
+	if err := upgradeStorage(dedup); err != nil {
+		log.Fatal(err)
+	}
+	keyfile, _ := opts.String("--keyfile")
+	if err := setupEncryption(keyfile); err != nil {
+		log.Fatal(err)
+	}
 	if i, _ := opts.Bool("-i"); i {
 		if err := importH2(opts["-t"].(string), opts["-c"].(string), opts["-r"].(string)); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
-	upgradeStorage()
-	c, err := fuse.Mount(mountpoint)
+	if dir, err := opts.String("--import-dir"); err == nil {
+		parent, _ := opts.String("--tag-parent")
+		move, _ := opts.Bool("--move")
+		if err := importDir(dir, parent, move); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if t, _ := opts.Bool("import-tmsu"); t {
+		if err := importTMSU(opts["<tmsudb>"].(string), opts["--tmsu-values"].(string)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if i, _ := opts.Bool("import-sidecars"); i {
+		tagMap, _ := opts.String("--tag-map")
+		move, _ := opts.Bool("--move")
+		if err := importSidecars(opts["<dir>"].(string), tagMap, opts["--unmapped"].(string), move); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if e, _ := opts.Bool("export"); e {
+		if err := exportJSON(opts["<json>"].(string), opts["<filesdir>"].(string)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if i, _ := opts.Bool("import"); i {
+		if err := importJSON(opts["<json>"].(string), opts["<filesdir>"].(string)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var trashAge time.Duration
+	if days, err := opts.String("--trash-days"); err == nil {
+		d, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			log.Fatal("Error parsing trash days:", err)
+		}
+		trashAge = time.Duration(d) * time.Hour * 24
+	}
+	if p, _ := opts.Bool("--purge-trash"); p {
+		purged, err := purgeTrash(trashAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Purged %d files from trash", purged)
+		return
+	}
+	// hashing sets the modification time so the timestamps go first
+	if err := runMigration("timestamps", migrateTimestamps); err != nil {
+		log.Fatal(err)
+	}
+	if err := runMigration("hashes", migrateHashes); err != nil {
+		log.Fatal(err)
+	}
+	if err := runMigration("sizes", migrateSizes); err != nil {
+		log.Fatal(err)
+	}
+	if trashAge > 0 && !readOnly {
+		go purgeTrashPeriodically(trashAge)
+	}
+	deleteLimit, err := strconv.ParseUint(opts["--delete-limit"].(string), 10, 32)
+	if err != nil {
+		log.Fatal("Error parsing delete limit:", err)
+	}
+	deleteWindow, err := strconv.ParseUint(opts["--delete-window"].(string), 10, 32)
+	if err != nil {
+		log.Fatal("Error parsing delete window:", err)
+	}
+	removeGuard = newDeleteGuard(int(deleteLimit), time.Duration(deleteWindow)*time.Second)
+	var mountOptions []fuse.MountOption
+	if readOnly {
+		mountOptions = append(mountOptions, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(mountpoint, mountOptions...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer c.Close()
-	cc := make(chan os.Signal)
+	cc := make(chan os.Signal, 1)
 	signal.Notify(cc, os.Interrupt)
 	signal.Notify(cc, syscall.SIGTERM)
 	go func() {
@@ -134,6 +266,7 @@ func main() {
 	}()
 	if fsckOpt, _ := opts.Bool("--fsck"); fsckOpt {
 		fix, _ := opts.Bool("-f")
+		verifyHashes, _ := opts.Bool("--hashes")
 		go func() {
 			defer func() {
 				log.Println("Wait for a second for file operations to finish before unmounting...")
@@ -148,7 +281,7 @@ func main() {
 				}
 				log.Println("Couldn't unmount the filesystem after fsck, please do it manually.")
 			}()
-			if err := fsck(fix); err != nil {
+			if err := fsck(fix, verifyHashes); err != nil {
 				log.Println("Check complete,", err)
 				return
 			}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/jinzhu/gorm"
+)
+
+func isDescendant(tx *gorm.DB, itemID, ancestorID id) (bool, error) {
+	var count int
+	err := tx.Raw("WITH RECURSIVE ancestors(id) AS (SELECT parent_id FROM items WHERE id = ? UNION "+
+		"SELECT i.parent_id FROM items i, ancestors a WHERE i.id = a.id AND i.parent_id <> 0) "+
+		"SELECT COUNT(*) FROM ancestors WHERE id = ?", itemID, ancestorID).Row().Scan(&count)
+	return count > 0, err
+}
+
+// mergeTags moves the files, groups, child tags, aliases and implications of src to dst and deletes src
+func mergeTags(src, dst *item) error {
+	if src.ID == dst.ID || src.Type != dst.Type {
+		return syscall.EINVAL
+	}
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	descendant, err := isDescendant(tx, dst.ID, src.ID)
+	if err != nil {
+		return err
+	}
+	if descendant {
+		// take dst out of the subtree being moved under it
+		if err := tx.Model(dst).Update("parent_id", src.ParentID).Error; err != nil {
+			return err
+		}
+	}
+	steps := []struct {
+		query string
+		args  []interface{}
+	}{
+		// the files and tags including the group
+		{"INSERT INTO item_tags(item_id, other_id) SELECT item_id, ? FROM item_tags WHERE other_id = ? AND " +
+			"item_id NOT IN (SELECT item_id FROM item_tags WHERE other_id = ?)", []interface{}{dst.ID, src.ID, dst.ID}},
+		// the groups included by the tag
+		{"INSERT INTO item_tags(item_id, other_id) SELECT ?, other_id FROM item_tags WHERE item_id = ? AND " +
+			"other_id NOT IN (SELECT other_id FROM item_tags WHERE item_id = ?)", []interface{}{dst.ID, src.ID, dst.ID}},
+		{"DELETE FROM item_tags WHERE other_id = ? OR item_id = ?", []interface{}{src.ID, src.ID}},
+		{"UPDATE items SET parent_id = ? WHERE parent_id = ? AND type IN (?)", []interface{}{dst.ID, src.ID, []itemType{tag, grouptag, alias}}},
+		{"UPDATE implications SET tag_id = ? WHERE tag_id = ? AND implied_id <> ?", []interface{}{dst.ID, src.ID, dst.ID}},
+		{"UPDATE implications SET implied_id = ? WHERE implied_id = ? AND tag_id <> ?", []interface{}{dst.ID, src.ID, dst.ID}},
+	}
+	for _, step := range steps {
+		if err := tx.Exec(step.query, step.args...).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Exec("DELETE FROM implications WHERE tag_id = ? OR implied_id = ? OR id NOT IN "+
+		"(SELECT MIN(id) FROM implications GROUP BY tag_id, implied_id)", src.ID, src.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Delete(&item{}, "id = ?", src.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+// findTagOrGroup finds the tag by name or alias, the tag groups are prefixed with !
+func findTagOrGroup(name string) (*item, error) {
+	if strings.HasPrefix(name, "!") {
+		var result item
+		if db.First(&result, "name = ? AND type = ?", name[1:], grouptag).RecordNotFound() {
+			return nil, fmt.Errorf("tag group %s not found", name[1:])
+		}
+		return &result, nil
+	}
+	return findTag(name)
+}
+
+func mergeCommand(srcName, dstName string) error {
+	src, err := findTagOrGroup(srcName)
+	if err != nil {
+		return err
+	}
+	dst, err := findTagOrGroup(dstName)
+	if err != nil {
+		return err
+	}
+	if err := mergeTags(src, dst); err != nil {
+		return fmt.Errorf("can't merge %s into %s: %v", srcName, dstName, err)
+	}
+	return nil
+}
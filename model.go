@@ -1,18 +1,29 @@
 package main
 
-import "bazil.org/fuse"
+import (
+	"time"
+
+	"bazil.org/fuse"
+)
 
 type id uint64
 
 type item struct {
-	ID       id
-	Name     string   `gorm:"index"`
-	Type     itemType `gorm:"index"`
-	ParentID id       `gorm:"index"`
-	Items    []*item  `gorm:"many2many:item_tags;association_jointable_foreignkey:other_id"`
-	Tag      string   `gorm:"-"`
-	missing  bool
-	tags     []string
+	ID         id
+	Name       string     `gorm:"index"`
+	Type       itemType   `gorm:"index"`
+	ParentID   id         `gorm:"index"`
+	Items      []*item    `gorm:"many2many:item_tags;association_jointable_foreignkey:other_id"`
+	TrashedAt  *time.Time `gorm:"index"`
+	TrashDir   id         `gorm:"index"`
+	Hash       string     `gorm:"index"`
+	CreatedAt  *time.Time `gorm:"index"`
+	ModifiedAt *time.Time
+	Notes      string
+	Size       *int64 `gorm:"index"`
+	Tag        string `gorm:"-"`
+	missing    bool
+	tags       []string
 }
 
 func (i *item) fuseType() fuse.DirentType {
@@ -36,4 +47,21 @@ const (
 	dir
 	tag
 	grouptag
+	alias
 )
+
+// migration marks a one-time database migration as finished
+type migration struct {
+	Name string `gorm:"primary_key"`
+}
+
+// runMigration runs the migration unless it has already finished, nothing is changed in read-only mode
+func runMigration(name string, migrate func() error) error {
+	if readOnly || !db.First(&migration{}, "name = ?", name).RecordNotFound() {
+		return nil
+	}
+	if err := migrate(); err != nil {
+		return err
+	}
+	return db.Create(&migration{Name: name}).Error
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// savedQuery is a path under browse like cats/_/dogs/@ saved under a short name
+type savedQuery struct {
+	ID    id
+	Name  string `gorm:"unique_index"`
+	Query string
+}
+
+// queriesDir contains the saved queries as symlinks to the query directories in browse. A query is
+// saved by creating a symlink or writing the query to a new file.
+type queriesDir struct{}
+
+// queryLink is the saved query
+type queryLink struct {
+	name string
+}
+
+// maxQuerySize limits the query written as a file
+const maxQuerySize = 4096
+
+// queryFile is the saved query being written as a file
+type queryFile struct {
+	name string
+	data []byte
+}
+
+// normalizeQuery turns the query or the path to it into the query relative to browse ending with
+// @ or @@ and checks that it exists
+func normalizeQuery(q string) (string, error) {
+	q = path.Clean(strings.TrimSpace(q))
+	if path.IsAbs(q) && mountpoint != "" {
+		if abs, err := filepath.Abs(mountpoint); err == nil && strings.HasPrefix(q, abs+"/") {
+			q = strings.TrimPrefix(q, abs)
+		}
+	}
+	q = strings.TrimPrefix(q, "../")
+	q = strings.TrimPrefix(strings.TrimPrefix(q, "/"), browse+"/")
+	if q == "." || q == browse || path.IsAbs(q) || strings.HasPrefix(q, "../") {
+		return "", syscall.EINVAL
+	}
+	if last := path.Base(q); last != contentTag && last != allTagsTag {
+		q = path.Join(q, contentTag)
+	}
+	node, err := lookupPath(path.Join(browse, q))
+	if err != nil {
+		return "", err
+	}
+	if _, ok := node.(filesDir); !ok {
+		return "", syscall.EINVAL
+	}
+	return q, nil
+}
+
+func saveQuery(name, q string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return syscall.EINVAL
+	}
+	q, err := normalizeQuery(q)
+	if err != nil {
+		return err
+	}
+	var existing savedQuery
+	if !db.First(&existing, "name = ?", name).RecordNotFound() {
+		return db.Model(&existing).Update("query", q).Error
+	}
+	return db.Create(&savedQuery{Name: name, Query: q}).Error
+}
+
+func findQuery(name string) (*savedQuery, error) {
+	var result savedQuery
+	if db.First(&result, "name = ?", name).RecordNotFound() {
+		return nil, syscall.ENOENT
+	}
+	return &result, nil
+}
+
+func (q queriesDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0755
+	attr.Size = 4096
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func (q queriesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var saved []savedQuery
+	if err := db.Order("name").Find(&saved).Error; err != nil {
+		return nil, err
+	}
+	result := emptyDirAlloc(len(saved))
+	for _, sq := range saved {
+		result = append(result, fuse.Dirent{Name: sq.Name, Type: fuse.DT_Link})
+	}
+	return result, nil
+}
+
+func (q queriesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if _, err := findQuery(name); err != nil {
+		return nil, err
+	}
+	return queryLink{name: name}, nil
+}
+
+func (q queriesDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if readOnly {
+		return nil, syscall.EROFS
+	}
+	if _, err := findQuery(req.NewName); err == nil {
+		return nil, syscall.EEXIST
+	}
+	if err := saveQuery(req.NewName, req.Target); err != nil {
+		return nil, err
+	}
+	return queryLink{name: req.NewName}, nil
+}
+
+func (q queriesDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if readOnly {
+		return nil, nil, syscall.EROFS
+	}
+	if _, err := findQuery(req.Name); err == nil {
+		return nil, nil, syscall.EEXIST
+	}
+	// the file becomes a symlink when it's closed
+	resp.EntryValid = 0
+	f := &queryFile{name: req.Name}
+	return f, f, nil
+}
+
+func (q queriesDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if readOnly {
+		return syscall.EROFS
+	}
+	if db.Delete(&savedQuery{}, "name = ?", req.Name).RowsAffected == 0 {
+		return syscall.ENOENT
+	}
+	return nil
+}
+
+func (q queriesDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if readOnly {
+		return syscall.EROFS
+	}
+	if _, ok := newDir.(queriesDir); !ok || strings.Contains(req.NewName, "/") {
+		return syscall.EINVAL
+	}
+	sq, err := findQuery(req.OldName)
+	if err != nil || req.OldName == req.NewName {
+		return err
+	}
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	if err := tx.Delete(&savedQuery{}, "name = ?", req.NewName).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(sq).Update("name", req.NewName).Error; err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (l queryLink) Attr(ctx context.Context, attr *fuse.Attr) error {
+	target, err := l.target()
+	if err != nil {
+		return err
+	}
+	attr.Mode = os.ModeSymlink | 0777
+	attr.Size = uint64(len(target))
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func (l queryLink) target() (string, error) {
+	sq, err := findQuery(l.name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("..", browse, sq.Query), nil
+}
+
+func (l queryLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.target()
+}
+
+func (f *queryFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = 0644
+	attr.Size = uint64(len(f.data))
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func (f *queryFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if req.Offset < 0 || req.Offset+int64(len(req.Data)) > maxQuerySize {
+		return syscall.EFBIG
+	}
+	end := int(req.Offset) + len(req.Data)
+	if end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[req.Offset:], req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Flush saves the query, it's called on every close so nothing is saved until the query is written
+func (f *queryFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if strings.TrimSpace(string(f.data)) == "" {
+		return nil
+	}
+	return saveQuery(f.name, string(f.data))
+}
+
+func setQueryCommand(name, q string) error {
+	if err := saveQuery(name, q); err != nil {
+		return fmt.Errorf("can't save %s: %v", name, err)
+	}
+	return nil
+}
+
+func rmQueryCommand(name string) error {
+	if db.Delete(&savedQuery{}, "name = ?", name).RowsAffected == 0 {
+		return fmt.Errorf("query %s not found", name)
+	}
+	return nil
+}
+
+func listQueries() error {
+	var saved []savedQuery
+	if err := db.Order("name").Find(&saved).Error; err != nil {
+		return err
+	}
+	for _, sq := range saved {
+		fmt.Printf("%s\t%s\n", sq.Name, sq.Query)
+	}
+	return nil
+}
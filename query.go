@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A path segment starting with queryPrefix is an expression like
+// cats and not (dogs or birds) and name:~"*.gif" and size>1M
+const queryPrefix = "="
+
+// queryNode is a node of the parsed query that compiles to an SQL condition on the items aliased i
+type queryNode interface {
+	sql() (string, []interface{}, error)
+}
+
+type (
+	andNode   []queryNode
+	orNode    []queryNode
+	notNode   struct{ node queryNode }
+	condition struct {
+		query  string
+		params []interface{}
+	}
+	// tagNode matches the items with any of the tags or, if inherit is set, any of their descendants
+	tagNode struct {
+		names   []string
+		inherit bool
+	}
+	// nameNode matches the name exactly or by nameFilter
+	nameNode struct {
+		pattern string
+		exact   bool
+	}
+	sizeNode struct {
+		op   string
+		size int64
+	}
+)
+
+func joinNodes(nodes []queryNode, op string) (string, []interface{}, error) {
+	if len(nodes) == 0 {
+		return "1", nil, nil
+	}
+	conditions := make([]string, len(nodes))
+	var params []interface{}
+	for i := range nodes {
+		cond, nodeParams, err := nodes[i].sql()
+		if err != nil {
+			return "", nil, err
+		}
+		conditions[i] = cond
+		params = append(params, nodeParams...)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], params, nil
+	}
+	return "(" + strings.Join(conditions, " "+op+" ") + ")", params, nil
+}
+
+func (n andNode) sql() (string, []interface{}, error) {
+	return joinNodes(n, "AND")
+}
+
+func (n orNode) sql() (string, []interface{}, error) {
+	return joinNodes(n, "OR")
+}
+
+func (n notNode) sql() (string, []interface{}, error) {
+	cond, params, err := n.node.sql()
+	return "NOT " + cond, params, err
+}
+
+func (n condition) sql() (string, []interface{}, error) {
+	return n.query, n.params, nil
+}
+
+func (n tagNode) sql() (string, []interface{}, error) {
+	names := n.names
+	if n.inherit {
+		var err error
+		if names, err = tagDescendants(names); err != nil {
+			return "", nil, err
+		}
+	}
+	cond, params := groupFilter(names)
+	return cond, params, nil
+}
+
+func (n nameNode) sql() (string, []interface{}, error) {
+	if n.exact {
+		return "i.name = ?", []interface{}{n.pattern}, nil
+	}
+	cond, pattern := nameFilter(n.pattern)
+	return cond, []interface{}{pattern}, nil
+}
+
+func (n sizeNode) sql() (string, []interface{}, error) {
+	return "i.size " + n.op + " ?", []interface{}{n.size}, nil
+}
+
+type tokenType int
+
+const (
+	wordToken tokenType = iota
+	stringToken
+	openToken
+	closeToken
+)
+
+type token struct {
+	typ   tokenType
+	value string
+}
+
+func tokenize(s string) ([]token, error) {
+	var result []token
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		switch c := r[i]; {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			result = append(result, token{typ: openToken, value: "("})
+			i++
+		case c == ')':
+			result = append(result, token{typ: closeToken, value: ")"})
+			i++
+		case c == '"':
+			var value []rune
+			for i++; ; i++ {
+				if i == len(r) {
+					return nil, fmt.Errorf("unterminated string in %s", s)
+				}
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				} else if r[i] == '"' {
+					break
+				}
+				value = append(value, r[i])
+			}
+			result = append(result, token{typ: stringToken, value: string(value)})
+			i++
+		default:
+			start := i
+			for i < len(r) && !unicode.IsSpace(r[i]) && r[i] != '(' && r[i] != ')' && r[i] != '"' {
+				i++
+			}
+			result = append(result, token{typ: wordToken, value: string(r[start:i])})
+		}
+	}
+	return result, nil
+}
+
+var (
+	namePredicate = regexp.MustCompile(`^name:(~?)(.*)$`)
+	sizePredicate = regexp.MustCompile(`^size(>=|<=|!=|>|<|=)(.+)$`)
+	sizeValue     = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)([kmgt]?)(?:i?b)?$`)
+)
+
+var sizeUnits = map[string]int64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40}
+
+// parseSize parses the sizes like 100, 1.5M or 2GiB, the units are powers of 1024
+func parseSize(s string) (int64, error) {
+	m := sizeValue.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	return int64(value * float64(sizeUnits[strings.ToLower(m[2])])), nil
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *queryParser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+// keyword reports if the next token is the unquoted keyword and consumes it
+func (p *queryParser) keyword(kw string) bool {
+	if t := p.peek(); t != nil && t.typ == wordToken && strings.EqualFold(t.value, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	var result orNode
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, node)
+		if !p.keyword("or") {
+			break
+		}
+	}
+	if len(result) == 1 {
+		return result[0], nil
+	}
+	return result, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	var result andNode
+	for {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, node)
+		if !p.keyword("and") {
+			break
+		}
+	}
+	if len(result) == 1 {
+		return result[0], nil
+	}
+	return result, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.keyword("not") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: node}, nil
+	}
+	t := p.peek()
+	if t == nil {
+		return nil, errors.New("unexpected end of query")
+	}
+	p.pos++
+	switch t.typ {
+	case openToken:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.typ != closeToken {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return node, nil
+	case stringToken:
+		return tagTerm(t.value)
+	case wordToken:
+		if m := namePredicate.FindStringSubmatch(t.value); m != nil {
+			pattern := m[2]
+			if pattern == "" {
+				next := p.peek()
+				if next == nil || next.typ != stringToken {
+					return nil, fmt.Errorf("name pattern expected after %s", t.value)
+				}
+				p.pos++
+				pattern = next.value
+			}
+			return nameNode{pattern: pattern, exact: m[1] == ""}, nil
+		}
+		if m := sizePredicate.FindStringSubmatch(t.value); m != nil {
+			size, err := parseSize(m[2])
+			if err != nil {
+				return nil, err
+			}
+			return sizeNode{op: m[1], size: size}, nil
+		}
+		switch strings.ToLower(t.value) {
+		case "and", "or":
+			return nil, fmt.Errorf("unexpected %s", t.value)
+		}
+		return tagTerm(t.value)
+	}
+	return nil, fmt.Errorf("unexpected %s", t.value)
+}
+
+func tagTerm(name string) (queryNode, error) {
+	t, ok := canonicalTag(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown tag %s", name)
+	}
+	return tagNode{names: []string{t.Name}, inherit: inheritTags}, nil
+}
+
+// parseQuery parses the query expression to the tree that compiles to SQL
+func parseQuery(s string) (queryNode, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty query")
+	}
+	p := queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, fmt.Errorf("unexpected %s", t.value)
+	}
+	return node, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func setupQueryDB(t *testing.T) {
+	var err error
+	if db, err = gorm.Open("sqlite3", ":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(item{})
+	for _, name := range []string{"a", "b", "c", "funny pics"} {
+		db.Create(&item{Name: name, Type: tag})
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	setupQueryDB(t)
+	defer db.Close()
+	tests := []struct {
+		query  string
+		sql    string
+		params []interface{}
+	}{
+		{"a", "? IN tags", []interface{}{"a"}},
+		{"a or b and not c", "(? IN tags OR (? IN tags AND NOT ? IN tags))", []interface{}{"a", "b", "c"}},
+		{"a and b or c", "((? IN tags AND ? IN tags) OR ? IN tags)", []interface{}{"a", "b", "c"}},
+		{"(a or b) and not c", "((? IN tags OR ? IN tags) AND NOT ? IN tags)", []interface{}{"a", "b", "c"}},
+		{"not (a and b)", "NOT (? IN tags AND ? IN tags)", []interface{}{"a", "b"}},
+		{"NOT not a", "NOT NOT ? IN tags", []interface{}{"a"}},
+		{`"funny pics" AND a`, "(? IN tags AND ? IN tags)", []interface{}{"funny pics", "a"}},
+		{`"and"or"a"`, "", nil},
+		{"size>1.5M", "i.size > ?", []interface{}{int64(1572864)}},
+		{"size<=10k", "i.size <= ?", []interface{}{int64(10240)}},
+		{"size!=2GiB", "i.size != ?", []interface{}{int64(2 << 30)}},
+		{"size=0", "i.size = ?", []interface{}{int64(0)}},
+		{`name:~"*.gif"`, "i.name GLOB ?", []interface{}{"*.gif"}},
+		{"name:~cat[0-9].jpg", "i.name GLOB ?", []interface{}{"cat[0-9].jpg"}},
+		{"name:~50%", `i.name LIKE ? ESCAPE '\'`, []interface{}{`%50\%%`}},
+		{`name:"a \"b\".jpg"`, "i.name = ?", []interface{}{`a "b".jpg`}},
+		{`a and name:~"*.gif" and size>1M`, "(? IN tags AND i.name GLOB ? AND i.size > ?)", []interface{}{"a", "*.gif", int64(1 << 20)}},
+	}
+	for _, tt := range tests {
+		node, err := parseQuery(tt.query)
+		if tt.sql == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		sql, params, err := node.sql()
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if sql != tt.sql || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s: got %s %v, want %s %v", tt.query, sql, params, tt.sql, tt.params)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	setupQueryDB(t)
+	defer db.Close()
+	for _, query := range []string{
+		"", "  ", "a and", "or a", "a or or b", "(a", "a)", "()", "a b", "not", "unknown", `"a`,
+		"name:", "name:~", "size>", "size>1Q", "size>-1", "size>1.5.5M",
+	} {
+		if _, err := parseQuery(query); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size int64
+	}{
+		{"100", 100}, {"100b", 100}, {"1K", 1024}, {"1kb", 1024}, {"1.5M", 1572864}, {"2MiB", 2 << 20},
+		{"1g", 1 << 30}, {"1T", 1 << 40},
+	}
+	for _, tt := range tests {
+		size, err := parseSize(tt.s)
+		if err != nil || size != tt.size {
+			t.Errorf("%s: got %d %v, want %d", tt.s, size, err, tt.size)
+		}
+	}
+}
+
+func TestTagQuery(t *testing.T) {
+	setupQueryDB(t)
+	defer db.Close()
+	tests := []struct {
+		tags   string
+		sql    string
+		params []interface{}
+	}{
+		{"a/b/@", "(? IN tags AND ? IN tags)", []interface{}{"b", "a"}},
+		{"a/_/b/+/c/@", "(NOT (? IN tags OR ? IN tags) AND ? IN tags)", []interface{}{"b", "c", "a"}},
+		{"a/=b or c/@", "(? IN tags AND (? IN tags OR ? IN tags))", []interface{}{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		node, err := filesDir{hasTags: hasTags{tags: tt.tags}}.tagQuery()
+		if err != nil {
+			t.Errorf("%s: %v", tt.tags, err)
+			continue
+		}
+		sql, params, err := node.sql()
+		if err != nil || sql != tt.sql || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s: got %s %v %v, want %s %v", tt.tags, sql, params, err, tt.sql, tt.params)
+		}
+	}
+	if _, err := (filesDir{hasTags: hasTags{tags: "a/=b/+/c/@"}}).tagQuery(); err != syscall.EINVAL {
+		t.Errorf("a/=b/+/c/@: got %v, want EINVAL", err)
+	}
+}
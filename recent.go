@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+type recentDir struct{}
+
+var recentPeriods = []string{"today", "week", "month", "year"}
+
+// periodStart returns the earliest creation time of files in the period
+func periodStart(period string) (time.Time, bool) {
+	now := time.Now()
+	switch period {
+	case "today":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()), true
+	case "week":
+		return now.AddDate(0, 0, -7), true
+	case "month":
+		return now.AddDate(0, -1, 0), true
+	case "year":
+		return now.AddDate(-1, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+func (r recentDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0755
+	attr.Size = 4096
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func (r recentDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	result := emptyDir()
+	for _, period := range recentPeriods {
+		result = append(result, fuse.Dirent{Name: period, Type: fuse.DT_Dir})
+	}
+	return result, nil
+}
+
+func (r recentDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	since, ok := periodStart(name)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return browseDir{hasTags: hasTags{since: since}, cache: newCache()}, nil
+}
+
+func (r recentDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return nil, nil, syscall.EACCES
+}
+
+// migrateTimestamps sets the creation and modification time of the files stored before they were
+// tracked to the modification time of their contents
+func migrateTimestamps() error {
+	var items []item
+	if err := db.Select("id, name, hash").Find(&items, "type = ? AND created_at IS NULL", file).Error; err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	log.Printf("Setting timestamps of %d files...", len(items))
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	for i := range items {
+		fi, err := store.Stat(&items[i])
+		if err != nil {
+			log.Printf("Error getting the modification time of %s [id %d]: %v", items[i].Name, items[i].ID, err)
+			continue
+		}
+		if err := tx.Model(&item{}).Where("id = ?", items[i].ID).
+			Updates(map[string]interface{}{"created_at": fi.ModTime(), "modified_at": fi.ModTime()}).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Println("Done.")
+	return nil
+}
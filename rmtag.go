@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+)
+
+// renaming a tag to its own name with this suffix in the same directory deletes it from all files
+const deleteSuffix = ".delete"
+
+// parseDeleteName checks if the new name deletes the tag: cats.delete just deletes cats,
+// cats.delete=kitties replaces it with kitties and cats.delete! allows leaving files without tags
+func parseDeleteName(oldName, newName string) (ok bool, replaceName string, allowUntagged bool) {
+	if !strings.HasPrefix(newName, oldName+deleteSuffix) {
+		return false, "", false
+	}
+	rest := newName[len(oldName+deleteSuffix):]
+	switch {
+	case rest == "":
+		return true, "", false
+	case rest == "!":
+		return true, "", true
+	case len(rest) > 1 && rest[0] == '=':
+		return true, rest[1:], false
+	}
+	return false, "", false
+}
+
+// renameToDelete deletes the tag renamed with the delete suffix, the reason of the failure is logged
+// as only the error code gets to the user
+func renameToDelete(t *item, replaceName string, allowUntagged bool) error {
+	var replace *item
+	if replaceName != "" {
+		var ok bool
+		if replace, ok = canonicalTag(replaceName); !ok {
+			log.Printf("Tag %s can't be replaced with %s, the tag doesn't exist", t.Name, replaceName)
+			return syscall.ENOENT
+		}
+	}
+	affected, untagged, err := deleteTag(t, replace, allowUntagged)
+	if err == syscall.EPERM {
+		log.Printf("Tag %s can't be deleted, %d files would be left without tags, rename it to %s%s! to allow that "+
+			"or to %s%s=tag to replace it", t.Name, len(untagged), t.Name, deleteSuffix, t.Name, deleteSuffix)
+	}
+	if err != nil {
+		return err
+	}
+	if replace != nil {
+		log.Printf("Replaced tag %s with %s in %d files", t.Name, replace.Name, affected)
+	} else {
+		log.Printf("Deleted tag %s from %d files", t.Name, affected)
+	}
+	return nil
+}
+
+// deleteTag deletes the tag that may still be assigned to files replacing it with another tag if
+// replace isn't nil. Unless allowUntagged is set it fails with EPERM returning the files that would
+// be left without tags.
+func deleteTag(t *item, replace *item, allowUntagged bool) (affected int, untagged []item, err error) {
+	if replace != nil && (replace.ID == t.ID || t.Type != tag) {
+		return 0, nil, syscall.EINVAL
+	}
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	if !tx.First(&item{}, "parent_id = ? AND type <> ?", t.ID, alias).RecordNotFound() {
+		return 0, nil, syscall.ENOTEMPTY
+	}
+	if err := tx.Table("item_tags").Joins("JOIN items ON items.id = item_tags.item_id").
+		Where("other_id = ? AND items.type IN (?)", t.ID, []itemType{file, dir}).Count(&affected).Error; err != nil {
+		return 0, nil, err
+	}
+	if replace == nil && !allowUntagged {
+		if err := tx.Raw("SELECT * FROM items WHERE type IN (?) AND id IN (SELECT item_id FROM item_tags WHERE other_id = ?) "+
+			"AND NOT EXISTS (SELECT 1 FROM item_tags WHERE item_id = items.id AND other_id <> ?)",
+			[]itemType{file, dir}, t.ID, t.ID).Scan(&untagged).Error; err != nil {
+			return 0, nil, err
+		}
+		if len(untagged) > 0 {
+			return affected, untagged, syscall.EPERM
+		}
+	}
+	if replace != nil {
+		replacements, err := withImplied(tx, []item{*replace})
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range replacements {
+			if err := tx.Exec("INSERT INTO item_tags(item_id, other_id) SELECT item_id, ? FROM item_tags WHERE other_id = ? AND "+
+				"item_id NOT IN (SELECT item_id FROM item_tags WHERE other_id = ?)", r.ID, t.ID, r.ID).Error; err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+	if err := tx.Exec("DELETE FROM item_tags WHERE other_id = ? OR item_id = ?", t.ID, t.ID).Error; err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Delete(&implication{}, "tag_id = ? OR implied_id = ?", t.ID, t.ID).Error; err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Delete(&item{}, "id = ? OR (parent_id = ? AND type = ?)", t.ID, t.ID, alias).Error; err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, nil, err
+	}
+	invalidateCache()
+	return affected, nil, nil
+}
+
+func rmtagCommand(name, replaceName string, allowUntagged bool) error {
+	t, err := findTagOrGroup(name)
+	if err != nil {
+		return err
+	}
+	var replace *item
+	if replaceName != "" {
+		if replace, err = findTag(replaceName); err != nil {
+			return err
+		}
+	}
+	affected, untagged, err := deleteTag(t, replace, allowUntagged)
+	if err == syscall.EPERM {
+		for _, i := range untagged {
+			fmt.Printf("|%d|%s\n", i.ID, i.Name)
+		}
+		return fmt.Errorf("%d files would be left without tags, use --replace or --allow-untagged", len(untagged))
+	}
+	if err != nil {
+		return fmt.Errorf("can't delete %s: %v", name, err)
+	}
+	if replace != nil {
+		log.Printf("Replaced %s with %s in %d files", name, replace.Name, affected)
+	} else {
+		log.Printf("Deleted %s from %d files", name, affected)
+	}
+	return nil
+}
@@ -10,9 +10,15 @@ import (
 )
 
 const (
-	control = "tags"
-	browse  = "browse"
-	debug   = "debug"
+	control  = "tags"
+	browse   = "browse"
+	trash    = "trash"
+	dupes    = "duplicates"
+	untagged = "untagged"
+	recent   = "recent"
+	fullText = "search"
+	queries  = "queries"
+	debug    = "debug"
 )
 
 type filesystem struct{}
@@ -49,6 +55,12 @@ func (d rootDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	result = append(result,
 		fuse.Dirent{Inode: 1, Name: control, Type: fuse.DT_Dir},
 		fuse.Dirent{Inode: 2, Name: browse, Type: fuse.DT_Dir},
+		fuse.Dirent{Inode: 3, Name: trash, Type: fuse.DT_Dir},
+		fuse.Dirent{Inode: 4, Name: dupes, Type: fuse.DT_Dir},
+		fuse.Dirent{Inode: 5, Name: untagged, Type: fuse.DT_Dir},
+		fuse.Dirent{Inode: 6, Name: recent, Type: fuse.DT_Dir},
+		fuse.Dirent{Inode: 7, Name: fullText, Type: fuse.DT_Dir},
+		fuse.Dirent{Inode: 8, Name: queries, Type: fuse.DT_Dir},
 	)
 	return result, nil
 }
@@ -63,6 +75,18 @@ func (d rootDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		return tagsDir{}, nil
 	case browse:
 		return browseDir{cache: newCache()}, nil
+	case trash:
+		return filesDir{allTags: true, trash: true, cache: newCache()}, nil
+	case dupes:
+		return duplicatesDir{}, nil
+	case untagged:
+		return filesDir{untagged: true, cache: newCache()}, nil
+	case recent:
+		return recentDir{}, nil
+	case fullText:
+		return ftsDir{}, nil
+	case queries:
+		return queriesDir{}, nil
 	}
 	return nil, syscall.ENOENT
 }
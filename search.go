@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// searchTag in query results is a directory where every name is a filter for the file names
+const searchTag = "?"
+
+// searchDir contains the results of dir filtered by file name
+type searchDir struct {
+	dir filesDir
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// nameFilter matches the names by glob if the pattern contains wildcards or by substring otherwise
+func nameFilter(pattern string) (string, interface{}) {
+	if strings.ContainsAny(pattern, "*?[") {
+		return "i.name GLOB ?", pattern
+	}
+	return `i.name LIKE ? ESCAPE '\'`, "%" + likeEscaper.Replace(pattern) + "%"
+}
+
+func (s searchDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0755
+	attr.Size = 4096
+	attr.Uid = uid
+	attr.Gid = gid
+	return nil
+}
+
+func (s searchDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return emptyDir(), nil
+}
+
+func (s searchDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	result := s.dir
+	result.search = name
+	result.cache = newCache()
+	return result, nil
+}
+
+func (s searchDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return nil, nil, syscall.EACCES
+}
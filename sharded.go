@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// shardedStorage keeps every file separately under its ID and name in directories derived from the ID
+type shardedStorage struct{}
+
+// shardedPath returns the file path relative to the storage directory
+func shardedPath(id uint64, name string) string {
+	return path.Join(fmt.Sprintf("%06d", id/10000), fmt.Sprintf("%02d", (id/100)%100), fmt.Sprintf("%010d_%s", id, name))
+}
+
+func filePathWithNameTx(id uint64, name string) (string, error) {
+	result := path.Join(storagePath, shardedPath(id, name))
+	os.MkdirAll(path.Dir(result), 0755)
+	return result, nil
+}
+
+func (shardedStorage) path(i *item) string {
+	path, _ := filePathWithNameTx(uint64(i.ID), i.Name)
+	return path
+}
+
+func (s shardedStorage) Open(i *item, flag int) (storageFile, error) {
+	return s.open(db, i, flag)
+}
+
+func (s shardedStorage) open(db *gorm.DB, i *item, flag int) (storageFile, error) {
+	path := s.path(i)
+	f, err := os.OpenFile(path, flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	if isReadOnly(flag) {
+		return f, nil
+	}
+	itemID := i.ID
+	return writtenFile{File: f, done: func() error {
+		return updateHash(db, itemID, path)
+	}}, nil
+}
+
+func (s shardedStorage) Create(db *gorm.DB, i *item) (storageFile, error) {
+	return s.open(db, i, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+func (s shardedStorage) Stat(i *item) (os.FileInfo, error) {
+	return os.Stat(s.path(i))
+}
+
+func (s shardedStorage) Remove(i *item) error {
+	if err := os.Remove(s.path(i)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s shardedStorage) Rename(i *item, oldName string) error {
+	from, err := filePathWithNameTx(uint64(i.ID), oldName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, s.path(i))
+}
+
+func (s shardedStorage) Truncate(i *item, size int64) error {
+	path := s.path(i)
+	if err := os.Truncate(path, size); err != nil {
+		return err
+	}
+	return updateHash(db, i.ID, path)
+}
+
+func (s shardedStorage) Walk(fn func(path string, i *item) error) error {
+	return walkSharded(func(_, name string) (string, error) { return name, nil }, fn)
+}
+
+func (s shardedStorage) OpenLost(path string) (string, io.ReadCloser, error) {
+	f, err := os.Open(path)
+	return filepath.Base(path), f, err
+}
+
+// walkSharded walks the sharded storage, decodeName converts the stored file names to the item names
+func walkSharded(decodeName func(itemID, name string) (string, error), fn func(path string, i *item) error) error {
+	return filepath.Walk(storagePath, func(path string, info os.FileInfo, _ error) error {
+		if info == nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(storagePath, path)
+		if err != nil {
+			return err
+		}
+		if isServiceFile(rel) {
+			return nil
+		}
+		match := filenameRegex.FindStringSubmatch(info.Name())
+		if match == nil {
+			log.Printf("Bad filename %s", path)
+			return fn(path, nil)
+		}
+		dir := filepath.Dir(rel)
+		id6, id2 := filepath.Split(dir)
+		id6 = filepath.Base(id6)
+		if len(id6) != 6 || len(id2) != 2 || !strings.HasPrefix(match[1], id6+id2) {
+			log.Printf("Invalid path %s/%s != %s", id6, id2, match[1])
+			return fn(path, nil)
+		}
+		name, err := decodeName(match[1], match[2])
+		if err != nil {
+			log.Printf("Bad filename %s: %v", path, err)
+			return fn(path, nil)
+		}
+		var i item
+		if db.First(&i, "id = ? AND name = ?", match[1], name).RecordNotFound() {
+			log.Printf("File %s is in storage but not in database", path)
+			return fn(path, nil)
+		}
+		return fn(path, &i)
+	})
+}
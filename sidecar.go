@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Unmapped sidecar tags are either created under importedTag or dropped
+const (
+	unmappedCreate = "create"
+	unmappedDrop   = "drop"
+	importedTag    = "imported"
+)
+
+var sidecarExts = []string{".json", ".txt"}
+
+// loadTagMap reads the lines like "sidecar_tag = tag", an empty tag drops the sidecar tag
+func loadTagMap(mapPath string) (map[string]string, error) {
+	result := map[string]string{}
+	if mapPath == "" {
+		return result, nil
+	}
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected sidecar_tag = tag", mapPath, n)
+		}
+		from, to := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if to != "" {
+			t, ok := canonicalTag(to)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: tag %s not found", mapPath, n, to)
+			}
+			to = t.Name
+		}
+		result[from] = to
+	}
+	return result, scanner.Err()
+}
+
+// jsonTags collects the tags from strings separated by spaces, lists and objects with lists
+func jsonTags(v interface{}) (result []string) {
+	switch t := v.(type) {
+	case string:
+		result = strings.Fields(t)
+	case []interface{}:
+		for _, e := range t {
+			result = append(result, jsonTags(e)...)
+		}
+	case map[string]interface{}:
+		for _, e := range t {
+			result = append(result, jsonTags(e)...)
+		}
+	}
+	return
+}
+
+// readSidecar returns the tags from the JSON metadata (tags, tag_string and their tags_*
+// variants) or the text file with the tags separated by spaces, commas or lines
+func readSidecar(sidecarPath string) ([]string, error) {
+	data, err := ioutil.ReadFile(sidecarPath)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(sidecarPath) != ".json" {
+		return strings.Fields(strings.ReplaceAll(string(data), ",", " ")), nil
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	var result []string
+	for k, v := range metadata {
+		if k == "tags" || k == "tag_string" || strings.HasPrefix(k, "tags_") || strings.HasPrefix(k, "tag_string_") {
+			result = append(result, jsonTags(v)...)
+		}
+	}
+	return result, nil
+}
+
+type sidecarImporter struct {
+	mapping  map[string]string
+	unmapped string
+	tags     map[string]*item
+}
+
+func (s *sidecarImporter) fileTags(names []string) ([]item, error) {
+	var result []item
+	seen := map[string]bool{}
+	for _, name := range names {
+		target, mapped := s.mapping[name]
+		if !mapped {
+			target = name
+		}
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		if !validTagName(target) {
+			log.Printf("Tag %s can't be imported", target)
+			continue
+		}
+		if t, ok := canonicalTag(target); ok {
+			result = append(result, *t)
+			continue
+		}
+		if s.unmapped == unmappedDrop {
+			continue
+		}
+		parent, err := importTag(db, s.tags, importedTag, 0)
+		if err != nil {
+			return nil, err
+		}
+		created, err := importTag(db, s.tags, target, parent.ID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *created)
+	}
+	return result, nil
+}
+
+// importSidecars adds the files from the directory tree with the tags from their sidecar files
+// named like image.jpg.json or image.jpg.txt
+func importSidecars(root, mapPath, unmapped string, move bool) error {
+	if unmapped != unmappedCreate && unmapped != unmappedDrop {
+		return fmt.Errorf("unknown unmapped tags mode %s", unmapped)
+	}
+	mapping, err := loadTagMap(mapPath)
+	if err != nil {
+		return err
+	}
+	var media []string
+	sidecars := map[string][]string{}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			media = append(media, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range media {
+		for _, ext := range sidecarExts {
+			if exists(p + ext) {
+				sidecars[p] = append(sidecars[p], p+ext)
+				sidecars[p+ext] = nil
+			}
+		}
+	}
+	importer := sidecarImporter{mapping: mapping, unmapped: unmapped, tags: map[string]*item{}}
+	imported, untagged, failed := 0, 0, 0
+	for _, p := range media {
+		files, ok := sidecars[p]
+		if ok && files == nil {
+			continue
+		}
+		if !isValidName(filepath.Base(p)) {
+			log.Printf("Skipping %s, file names can't contain |", p)
+			continue
+		}
+		var names []string
+		for _, sidecar := range files {
+			sidecarTags, err := readSidecar(sidecar)
+			if err != nil {
+				log.Printf("Error reading %s: %v", sidecar, err)
+			}
+			names = append(names, sidecarTags...)
+		}
+		tags, err := importer.fileTags(names)
+		if err == nil {
+			tags, err = withImplied(db, tags)
+		}
+		if err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			untagged++
+		}
+		f := importedFile{src: p, item: item{Name: filepath.Base(p), Type: file}}
+		if err := db.Create(&f.item).Association("Items").Append(tags).Error; err != nil {
+			return err
+		}
+		if err := copyToStorage(db, p, &f.item); err != nil {
+			log.Printf("Error importing %s: %v", p, err)
+			failed++
+			if err := deleteItem(&f.item); err != nil {
+				return err
+			}
+			continue
+		}
+		if move {
+			os.Remove(p)
+			for _, sidecar := range files {
+				os.Remove(sidecar)
+			}
+		}
+		imported++
+	}
+	invalidateCache()
+	log.Printf("Imported %d files (%d without tags), %d failed", imported, untagged, failed)
+	return nil
+}
@@ -1,15 +1,69 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+
+	"github.com/jinzhu/gorm"
 )
 
+// storageFile is an open file in the storage, closing a file opened for writing finishes the write
+type storageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+}
+
+// Storage keeps the file contents, items passed to it should have their ID, Name and Hash set
+type Storage interface {
+	Open(i *item, flag int) (storageFile, error)
+	// Create stores the hash of the new file through db when it's closed so it can be a transaction
+	Create(db *gorm.DB, i *item) (storageFile, error)
+	Stat(i *item) (os.FileInfo, error)
+	// Remove is called after the item is deleted from the database
+	Remove(i *item) error
+	// Rename is called after the item is renamed
+	Rename(i *item, oldName string) error
+	Truncate(i *item, size int64) error
+	// Walk calls fn for every file in the storage with the item it belongs to or nil if it's lost
+	Walk(fn func(path string, i *item) error) error
+	// OpenLost opens a lost file found by Walk and returns its name and contents
+	OpenLost(path string) (string, io.ReadCloser, error)
+}
+
+var store Storage = shardedStorage{}
+
+// isServiceFile reports if the file in the storage is not a part of the stored files
+func isServiceFile(rel string) bool {
+	return rel == "version.txt" || rel == encryptionFile || rel == encryptingFile
+}
+
+func isReadOnly(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) == 0
+}
+
+// writtenFile finishes the write when closed
+type writtenFile struct {
+	*os.File
+	done func() error
+}
+
+func (w writtenFile) Close() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	return w.done()
+}
+
 func makeOldDir(version int) (string, error) {
 	olddir := path.Clean(storagePath) + "_v" + strconv.FormatInt(int64(version), 10)
 	fi, err := os.Stat(olddir)
@@ -28,7 +82,7 @@ func logMigrationEnd(version int) {
 	log.Printf("Successfully migrated from ver %d to %d", version, version+1)
 }
 
-func upgradeStorage() error {
+func upgradeStorage(dedup bool) error {
 	version := 1
 	verpath := path.Join(storagePath, "version.txt")
 	verstr, err := ioutil.ReadFile(verpath)
@@ -77,10 +131,32 @@ func upgradeStorage() error {
 			})
 			logMigrationEnd(version)
 			version++
+		case 2:
+			if !dedup {
+				needUpgrade = false
+				continue
+			}
+			if exists(path.Join(storagePath, encryptionFile)) {
+				return errors.New("deduplication of the encrypted storage is not supported")
+			}
+			logMigrationStart(version)
+			if err := migrateToDedup(); err != nil {
+				return err
+			}
+			logMigrationEnd(version)
+			version++
 		default:
 			needUpgrade = false
 		}
 	}
+	if version >= 3 {
+		store = dedupStorage{}
+		// finish the writes interrupted by a crash
+		if err := unstageAll(); err != nil {
+			return err
+		}
+	}
+	os.MkdirAll(storagePath, 0755)
 	ioutil.WriteFile(verpath, []byte(strconv.FormatInt(int64(version), 10)), 0644)
 	return nil
 }
@@ -17,9 +17,20 @@ type tagsDir struct {
 	ID id
 }
 
-var relatedRegexp = regexp.MustCompile(`(^[^\|]*) \|(.*)\|$`)
+var (
+	relatedRegexp = regexp.MustCompile(`(^[^\|]*) \|(.*)\|$`)
+	aliasesRegexp = regexp.MustCompile(`(^[^~]*) ~(.*)~$`)
+)
+
+func splitNames(s string) []string {
+	result := strings.Split(s, ",")
+	for i := range result {
+		result[i] = strings.TrimSpace(result[i])
+	}
+	return result
+}
 
-func parseName(i *item) (related []string, err error) {
+func parseName(i *item) (related []string, aliases []string, err error) {
 	filteredName := i.Name
 	if strings.HasPrefix(filteredName, "!") {
 		filteredName = filteredName[1:]
@@ -27,21 +38,29 @@ func parseName(i *item) (related []string, err error) {
 	} else {
 		i.Type = tag
 	}
+	if matches := aliasesRegexp.FindStringSubmatch(filteredName); matches != nil {
+		if i.Type == grouptag {
+			return nil, nil, syscall.EINVAL
+		}
+		filteredName = matches[1]
+		// explicit empty aliases remove them
+		aliases = []string{}
+		if strings.TrimSpace(matches[2]) != "" {
+			aliases = splitNames(matches[2])
+		}
+	}
 	matches := relatedRegexp.FindStringSubmatch(filteredName)
 	if matches != nil {
 		filteredName = matches[1]
-		related = strings.Split(matches[2], ",")
+		related = splitNames(matches[2])
 	} else {
 		if strings.ContainsAny(filteredName, "|") {
-			return nil, syscall.EINVAL
+			return nil, nil, syscall.EINVAL
 		}
 	}
 	i.Name = filteredName
 	if i.Type == grouptag && len(related) > 0 {
-		return nil, syscall.EINVAL
-	}
-	for i := range related {
-		related[i] = strings.TrimSpace(related[i])
+		return nil, nil, syscall.EINVAL
 	}
 	return
 }
@@ -67,6 +86,9 @@ func itemtype(s string) itemType {
 
 func basetag(s string) string {
 	itemName := strings.TrimPrefix(s, "!")
+	if matches := aliasesRegexp.FindStringSubmatch(itemName); matches != nil {
+		itemName = matches[1]
+	}
 	matches := relatedRegexp.FindStringSubmatch(itemName)
 	if matches != nil {
 		itemName = matches[1]
@@ -103,6 +125,9 @@ func (t tagsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			}
 			name += " |" + strings.Join(names, ", ") + "|"
 		}
+		if aliases := tagAliases(v.ID); len(aliases) > 0 {
+			name += " ~" + strings.Join(aliases, ", ") + "~"
+		}
 		result = append(result, fuse.Dirent{Inode: uint64(v.ID), Name: name, Type: fuse.DT_Dir})
 	}
 	return result, nil
@@ -123,8 +148,9 @@ func compareRelated(items []item, related []string) bool {
 func (t tagsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	var src, result item
 	src.Name = name
-	related, err := parseName(&src)
+	related, aliases, err := parseName(&src)
 	sort.Strings(related)
+	sort.Strings(aliases)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +158,7 @@ func (t tagsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		if result.Type == src.Type {
 			var relatedExisting []item
 			db.Model(&result).Order("name ASC").Related(&relatedExisting, "Items")
-			if compareRelated(relatedExisting, related) {
+			if compareRelated(relatedExisting, related) && strings.Join(tagAliases(result.ID), ",") == strings.Join(aliases, ",") {
 				return tagsDir{ID: result.ID}, nil
 			}
 		}
@@ -141,12 +167,15 @@ func (t tagsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 }
 
 func (t tagsDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if readOnly {
+		return nil, syscall.EROFS
+	}
 	newItem := item{Name: req.Name, ParentID: t.ID}
-	related, err := parseName(&newItem)
+	related, aliases, err := parseName(&newItem)
 	if err != nil {
 		return nil, err
 	}
-	if !db.First(&item{}, "name = ? AND type = ?", newItem.Name, newItem.Type).RecordNotFound() {
+	if !db.First(&item{}, "name = ? AND type IN (?)", newItem.Name, sameNamespace(newItem.Type)).RecordNotFound() {
 		return nil, syscall.EEXIST
 	}
 	tx := db.Begin()
@@ -157,17 +186,23 @@ func (t tagsDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, er
 	if err := updateRelated(tx, &newItem, related); err != nil {
 		return nil, err
 	}
+	if err := updateAliases(tx, &newItem, aliases); err != nil {
+		return nil, err
+	}
 	invalidateCache()
 	tx.Commit()
 	return tagsDir{ID: newItem.ID}, nil
 }
 
 func (t tagsDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if readOnly {
+		return syscall.EROFS
+	}
 	var target item
 	if db.First(&target, "name = ? AND parent_id = ? AND type = ?", basetag(req.Name), t.ID, itemtype(req.Name)).RecordNotFound() {
 		return syscall.ENOENT
 	}
-	if !db.First(&item{}, "parent_id = ?", target.ID).RecordNotFound() {
+	if !db.First(&item{}, "parent_id = ? AND type <> ?", target.ID, alias).RecordNotFound() {
 		return syscall.ENOTEMPTY
 	}
 	var files uint64
@@ -175,12 +210,16 @@ func (t tagsDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	if files > 0 {
 		return syscall.ENOTEMPTY
 	}
-	db.Delete(&item{}, "id = ?", target.ID)
+	db.Delete(&item{}, "id = ? OR (parent_id = ? AND type = ?)", target.ID, target.ID, alias)
+	db.Delete(&implication{}, "tag_id = ? OR implied_id = ?", target.ID, target.ID)
 	invalidateCache()
 	return nil
 }
 
 func (t tagsDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if readOnly {
+		return syscall.EROFS
+	}
 	targetDir, ok := newDir.(tagsDir)
 	if !ok {
 		return syscall.EINVAL
@@ -189,17 +228,44 @@ func (t tagsDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.
 	if db.First(&src, "name = ? AND parent_id = ? AND type = ?", basetag(req.OldName), t.ID, itemtype(req.OldName)).RecordNotFound() {
 		return syscall.ENOENT
 	}
+	if targetDir.ID == t.ID {
+		if ok, replaceName, allowUntagged := parseDeleteName(basetag(req.OldName), basetag(req.NewName)); ok {
+			return renameToDelete(&src, replaceName, allowUntagged)
+		}
+	}
+	original := src
 	src.ParentID = targetDir.ID
 	src.Name = req.NewName
-	related, err := parseName(&src)
+	related, aliases, err := parseName(&src)
 	if err != nil {
 		return err
 	}
+	var existing item
+	if !db.First(&existing, "name = ? AND type IN (?) AND id <> ?", src.Name, sameNamespace(src.Type), src.ID).RecordNotFound() {
+		// renaming onto another tag merges them
+		if existing.Type == alias {
+			if existing.ParentID == src.ID {
+				return syscall.EEXIST
+			}
+			aliased, ok := canonicalTag(existing.Name)
+			if !ok {
+				return syscall.ENOENT
+			}
+			existing = *aliased
+		}
+		return mergeTags(&original, &existing)
+	}
 	tx := db.Begin()
 	defer tx.RollbackUnlessCommitted()
 	if err := updateRelated(tx, &src, related); err != nil {
 		return err
 	}
+	// the aliases are kept unless the new name specifies them
+	if aliases != nil {
+		if err := updateAliases(tx, &src, aliases); err != nil {
+			return err
+		}
+	}
 	tx.Save(&src)
 	tx.Commit()
 	invalidateCache()
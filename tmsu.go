@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jinzhu/gorm"
+)
+
+var errTagTaken = errors.New("the name is taken by a tag with another parent")
+
+// TMSU tag values are imported either as child tags of the tag or as separate tags named tag=value
+const (
+	tmsuValuesChild = "child"
+	tmsuValuesFlat  = "flat"
+)
+
+type tmsuFile struct {
+	ID        uint64
+	Directory string
+	Name      string
+	IsDir     bool
+}
+
+type tmsuImporter struct {
+	tmsu       *gorm.DB
+	flatValues bool
+	tags       map[string]*item
+	// child value tags by the parent tag name and value
+	values map[string]*item
+}
+
+// valueTag returns the child tag of the parent named after the value. Tag names are global so if
+// the name is already taken by another tag the value is imported as tag=value instead.
+func (t *tmsuImporter) valueTag(parent *item, value string) (*item, error) {
+	key := parent.Name + "=" + value
+	if v, ok := t.values[key]; ok {
+		return v, nil
+	}
+	var existing item
+	if db.First(&existing, "name = ? AND type IN (?)", value, []itemType{tag, alias}).RecordNotFound() {
+		existing = item{Name: value, Type: tag, ParentID: parent.ID}
+		if err := db.Create(&existing).Error; err != nil {
+			return nil, err
+		}
+		log.Printf("Created tag %s", value)
+	} else if existing.Type != tag || existing.ParentID != parent.ID {
+		log.Printf("Tag %s already exists, value %s of tag %s is imported as %s", value, value, parent.Name, key)
+		if !validTagName(key) {
+			return nil, fmt.Errorf("value %s of tag %s can't be imported", value, parent.Name)
+		}
+		v, err := t.tag(key, parent.ID)
+		if err != nil {
+			return nil, err
+		}
+		t.values[key] = v
+		return v, nil
+	}
+	t.values[key] = &existing
+	return &existing, nil
+}
+
+// tag finds the tag by name or alias under the parent or creates it there, tag names are global so
+// a tag with the same name elsewhere (like a value of another tag) can't be used
+func (t *tmsuImporter) tag(name string, parentID id) (*item, error) {
+	if result, ok := t.tags[name]; ok {
+		if result.ParentID != parentID {
+			return nil, errTagTaken
+		}
+		return result, nil
+	}
+	var result, a item
+	found := !db.First(&result, "name = ? AND type = ? AND parent_id = ?", name, tag, parentID).RecordNotFound() ||
+		!db.First(&a, "name = ? AND type = ?", name, alias).RecordNotFound() &&
+			!db.First(&result, "id = ? AND type = ? AND parent_id = ?", a.ParentID, tag, parentID).RecordNotFound()
+	if !found {
+		if !db.First(&item{}, "name = ? AND type IN (?)", name, []itemType{tag, alias}).RecordNotFound() {
+			return nil, errTagTaken
+		}
+		result = item{Name: name, Type: tag, ParentID: parentID}
+		if err := db.Create(&result).Error; err != nil {
+			return nil, err
+		}
+	}
+	t.tags[name] = &result
+	return &result, nil
+}
+
+func (t *tmsuImporter) fileTags(fileID uint64) ([]item, error) {
+	rows, err := t.tmsu.Raw("SELECT t.name, COALESCE(v.name, '') FROM file_tag ft JOIN tag t ON t.id = ft.tag_id "+
+		"LEFT JOIN value v ON v.id = ft.value_id WHERE ft.file_id = ?", fileID).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []item
+	for rows.Next() {
+		var tagName, value string
+		if err := rows.Scan(&tagName, &value); err != nil {
+			return nil, err
+		}
+		if !validTagName(tagName) {
+			log.Printf("Tag %s can't be imported, file %d won't have it", tagName, fileID)
+			continue
+		}
+		parent, err := t.tag(tagName, 0)
+		if err == errTagTaken {
+			log.Printf("Tag %s already exists under another tag, file %d won't have it", tagName, fileID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			result = append(result, *parent)
+			continue
+		}
+		valueName := value
+		if t.flatValues {
+			valueName = tagName + "=" + value
+		}
+		if !validTagName(valueName) {
+			log.Printf("Value %s of tag %s can't be imported, file %d won't have it", value, tagName, fileID)
+			continue
+		}
+		var valueTag *item
+		if t.flatValues {
+			valueTag, err = t.tag(valueName, parent.ID)
+		} else {
+			valueTag, err = t.valueTag(parent, value)
+		}
+		if err == errTagTaken {
+			log.Printf("Value %s of tag %s already exists under another tag, file %d won't have it", value, tagName, fileID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *valueTag)
+	}
+	return result, rows.Err()
+}
+
+// importTMSU imports the tags and files from the TMSU database, the files are copied to the storage
+func importTMSU(tmsuPath string, values string) error {
+	if values != tmsuValuesChild && values != tmsuValuesFlat {
+		return fmt.Errorf("unknown values mode %s", values)
+	}
+	// opening creates an empty database if the path is wrong
+	if _, err := os.Stat(tmsuPath); err != nil {
+		return err
+	}
+	tmsu, err := gorm.Open("sqlite3", tmsuPath)
+	if err != nil {
+		return err
+	}
+	defer tmsu.Close()
+	var files []tmsuFile
+	if err := tmsu.Raw("SELECT id, directory, name, is_dir FROM file ORDER BY id").Scan(&files).Error; err != nil {
+		return err
+	}
+	importer := tmsuImporter{tmsu: tmsu, flatValues: values == tmsuValuesFlat, tags: map[string]*item{}, values: map[string]*item{}}
+	var missing []string
+	imported := 0
+	for _, f := range files {
+		src := filepath.Join(f.Directory, f.Name)
+		if f.IsDir {
+			log.Printf("Directory %s is skipped, only files can be imported", src)
+			continue
+		}
+		if !isValidName(f.Name) {
+			log.Printf("File %s is skipped, file names can't contain |", src)
+			continue
+		}
+		if _, err := os.Stat(src); err != nil {
+			missing = append(missing, src)
+			continue
+		}
+		tags, err := importer.fileTags(f.ID)
+		if err == nil {
+			tags, err = withImplied(db, tags)
+		}
+		if err != nil {
+			return err
+		}
+		newItem := item{Name: f.Name, Type: file}
+		if err := db.Create(&newItem).Association("Items").Append(tags).Error; err != nil {
+			return err
+		}
+		if err := copyToStorage(db, src, &newItem); err != nil {
+			log.Printf("Error copying file %s: %v", src, err)
+			missing = append(missing, src)
+			if err := deleteItem(&newItem); err != nil {
+				return err
+			}
+			continue
+		}
+		imported++
+	}
+	invalidateCache()
+	for _, m := range missing {
+		log.Printf("File not found: %s", m)
+	}
+	tagIDs := map[id]bool{}
+	for _, m := range []map[string]*item{importer.tags, importer.values} {
+		for _, t := range m {
+			tagIDs[t.ID] = true
+		}
+	}
+	log.Printf("Imported %d files, %d tags, %d files couldn't be found", imported, len(tagIDs), len(missing))
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"syscall"
+	"time"
+)
+
+// trashItem marks the file or the emptied directory as deleted keeping it in the storage along with
+// its tags. Trashed items are moved to the root and their directory is remembered to restore them
+// there.
+func trashItem(i *item) error {
+	now := time.Now()
+	if err := db.Model(&item{}).Where("id = ?", i.ID).
+		Updates(map[string]interface{}{"trashed_at": &now, "trash_dir": i.ParentID, "parent_id": 0}).Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+// hasTrashedItems reports if some trashed items were deleted from the directory
+func hasTrashedItems(dirID id) bool {
+	return !db.First(&item{}, "trashed_at IS NOT NULL AND trash_dir = ?", dirID).RecordNotFound()
+}
+
+// restoreDir untrashes the directory the item was trashed from along with its parents, the item is
+// restored to the root if the directory doesn't exist anymore
+func restoreDir(dirID id) (id, error) {
+	if dirID == 0 {
+		return 0, nil
+	}
+	var d item
+	if db.First(&d, "id = ? AND type = ?", dirID, dir).RecordNotFound() {
+		return 0, nil
+	}
+	if d.TrashedAt == nil {
+		return d.ID, nil
+	}
+	parentID, err := restoreDir(d.TrashDir)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.Model(&item{}).Where("id = ?", d.ID).
+		Updates(map[string]interface{}{"trashed_at": nil, "trash_dir": 0, "parent_id": parentID}).Error; err != nil {
+		return 0, err
+	}
+	return d.ID, nil
+}
+
+// purgeTrash permanently deletes the files that were trashed earlier than olderThan ago and the
+// trashed directories no file can be restored to
+func purgeTrash(olderThan time.Duration) (int, error) {
+	var items []item
+	if err := db.Find(&items, "type = ? AND trashed_at IS NOT NULL AND trashed_at < ?", file, time.Now().Add(-olderThan)).Error; err != nil {
+		return 0, err
+	}
+	purged := 0
+	for i := range items {
+		if err := deleteItem(&items[i]); err != nil {
+			log.Printf("Error purging file %s [id %d]: %v", items[i].Name, items[i].ID, err)
+			continue
+		}
+		purged++
+	}
+	// the nested directories are freed one level at a time
+	for {
+		var dirs []item
+		if err := db.Find(&dirs, "type = ? AND trashed_at IS NOT NULL AND id NOT IN "+
+			"(SELECT trash_dir FROM items WHERE trashed_at IS NOT NULL)", dir).Error; err != nil {
+			return purged, err
+		}
+		deleted := 0
+		for i := range dirs {
+			if err := deleteItem(&dirs[i]); err != nil {
+				if err != syscall.ENOTEMPTY {
+					log.Printf("Error purging directory %s [id %d]: %v", dirs[i].Name, dirs[i].ID, err)
+				}
+				continue
+			}
+			deleted++
+		}
+		if deleted == 0 {
+			return purged, nil
+		}
+	}
+}
+
+func purgeTrashPeriodically(olderThan time.Duration) {
+	for {
+		if purged, err := purgeTrash(olderThan); err != nil {
+			log.Println("Error purging trash:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d files from trash", purged)
+		}
+		time.Sleep(time.Hour)
+	}
+}
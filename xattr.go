@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	tagsXattr  = "user.memetagfs.tags"
+	notesXattr = "user.memetagfs.notes"
+)
+
+func itemTags(db *gorm.DB, itemID id) ([]item, error) {
+	var tags []item
+	if err := db.Model(&item{ID: itemID}).Order("name ASC").Related(&tags, "Items").Error; err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// addMissingTags appends the tags that aren't in the list yet
+func addMissingTags(tags []item, more []item) []item {
+	seen := map[id]bool{}
+	for _, t := range tags {
+		seen[t.ID] = true
+	}
+	for _, t := range more {
+		if !seen[t.ID] {
+			seen[t.ID] = true
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func parseTagList(s string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// setItemTags replaces all tags of the item in one transaction, only the added tags bring the tags
+// they imply so that an implied tag can be removed
+func setItemTags(itemID id, names []string) error {
+	names = parseTagList(strings.Join(canonicalNames(names), ","))
+	var tags []item
+	if len(names) > 0 {
+		if err := db.Find(&tags, "name IN (?) AND type = ?", names, tag).Error; err != nil {
+			return err
+		}
+		if len(tags) != len(names) {
+			return syscall.EINVAL
+		}
+	}
+	current, err := itemTags(db, itemID)
+	if err != nil {
+		return err
+	}
+	had := map[id]bool{}
+	for _, t := range current {
+		had[t.ID] = true
+	}
+	var added []item
+	for _, t := range tags {
+		if !had[t.ID] {
+			added = append(added, t)
+		}
+	}
+	implied, err := withImplied(db, added)
+	if err != nil {
+		return err
+	}
+	tags = addMissingTags(tags, implied[len(added):])
+	tx := db.Begin()
+	defer tx.RollbackUnlessCommitted()
+	model := tx.Model(&item{ID: itemID}).Association("Items")
+	if len(tags) > 0 {
+		model = model.Replace(tags)
+	} else {
+		model = model.Clear()
+	}
+	if model.Error != nil {
+		return model.Error
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+// setNotes replaces the free-text notes of the item that are included in the full-text search
+func setNotes(itemID id, notes string) error {
+	if err := db.Model(&item{}).Where("id = ?", itemID).Update("notes", notes).Error; err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+func (c content) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name == notesXattr {
+		var i item
+		if db.Select("notes").First(&i, "id = ?", c.id).RecordNotFound() || i.Notes == "" {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(i.Notes)
+		return nil
+	}
+	if req.Name != tagsXattr {
+		return fuse.ErrNoXattr
+	}
+	tags, err := itemTags(db, id(c.id))
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(tags))
+	for i := range tags {
+		names[i] = tags[i].Name
+	}
+	resp.Xattr = []byte(strings.Join(names, ", "))
+	return nil
+}
+
+func (c content) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	resp.Append(tagsXattr, notesXattr)
+	return nil
+}
+
+func (c content) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if readOnly {
+		return syscall.EROFS
+	}
+	if req.Name == notesXattr {
+		return setNotes(id(c.id), string(req.Xattr))
+	}
+	if req.Name != tagsXattr {
+		return syscall.ENOTSUP
+	}
+	return setItemTags(id(c.id), parseTagList(string(req.Xattr)))
+}
+
+func (c content) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if readOnly {
+		return syscall.EROFS
+	}
+	if req.Name == notesXattr {
+		return setNotes(id(c.id), "")
+	}
+	if req.Name != tagsXattr {
+		return fuse.ErrNoXattr
+	}
+	return setItemTags(id(c.id), nil)
+}